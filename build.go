@@ -6,13 +6,15 @@ import (
 	"strings"
 
 	"github.com/nlopes/slack"
+	"github.com/vivitInc/maguro/config"
 	"github.com/vivitInc/maguro/drone"
 	"go.uber.org/zap"
 )
 
 type Build struct {
-	slack *slack.Client
-	drone *drone.Drone
+	slack  slackClient
+	drone  *drone.Servers
+	config *config.Config
 }
 
 func BuildAttachmentFileds(name, build string) []slack.AttachmentField {
@@ -31,7 +33,7 @@ func BuildAttachmentFileds(name, build string) []slack.AttachmentField {
 }
 
 func (b *Build) SelectRepo(event *slack.MessageEvent) {
-	repos, err := b.drone.GetRepositories()
+	repos, err := b.drone.GetRepositories(b.config.Owners)
 	if err != nil {
 		logger.Error("Failed to get repositories", zap.String("detail", err.Error()))
 	}
@@ -68,8 +70,7 @@ func (b *Build) SelectBuild(message *slack.AttachmentActionCallback) *slack.Mess
 	// Format: {owner}/{repo}
 	value := message.Actions[0].SelectedOptions[0].Value
 
-	repo := drone.GetRepoFromFullName(value)
-	builds, err := b.drone.GetRunningBuildNumber(repo)
+	builds, err := b.drone.ForRepo(value).GetRunningBuildNumber(value)
 	if err != nil {
 		logger.Error("Failed to get running build", zap.String("detail", err.Error()))
 		originalMessage.Attachments = Message(fmt.Sprintf("エラーが発生したよ！\n%s", err), "danger")
@@ -85,7 +86,7 @@ func (b *Build) SelectBuild(message *slack.AttachmentActionCallback) *slack.Mess
 	for i, build := range builds {
 		options[i] = slack.AttachmentActionOption{
 			Text:  fmt.Sprintf("%d: %s %s", build.Number, build.Commit, build.Message),
-			Value: fmt.Sprintf("%s:%d", repo.FullName(), build.Number),
+			Value: fmt.Sprintf("%s:%d", value, build.Number),
 		}
 	}
 
@@ -118,13 +119,12 @@ func (b *Build) Restart(message *slack.AttachmentActionCallback) *slack.Message
 	originalMessage := message.OriginalMessage
 
 	strs := strings.Split(message.Actions[0].Value, ":")
-	repo := drone.GetRepoFromFullName(strs[0])
 	number, err := strconv.Atoi(strs[1])
 	if err != nil {
 		originalMessage.Attachments = Message(fmt.Sprintf("%dを再実行できなかった...", number), "danger")
 		return &originalMessage
 	}
-	if err := b.drone.RestartBuild(*repo, number); err != nil {
+	if err := b.drone.ForRepo(strs[0]).RestartBuild(strs[0], number); err != nil {
 		originalMessage.Attachments = Message(fmt.Sprintf("%dを再実行できなかった...", number), "danger")
 		return &originalMessage
 	}
@@ -137,14 +137,13 @@ func (b *Build) Restart(message *slack.AttachmentActionCallback) *slack.Message
 func (b *Build) Stop(message *slack.AttachmentActionCallback) *slack.Message {
 	originalMessage := message.OriginalMessage
 	strs := strings.Split(message.Actions[0].Value, ":")
-	repo := drone.GetRepoFromFullName(strs[0])
 
 	build, err := strconv.Atoi(strs[1])
 	if err != nil {
 		originalMessage.Attachments = Message("止めるの失敗した...", "danger")
 		return &originalMessage
 	}
-	if err := b.drone.KillBuild(*repo, build); err != nil {
+	if err := b.drone.ForRepo(strs[0]).KillBuild(strs[0], build); err != nil {
 		originalMessage.Attachments = Message(fmt.Sprintf("%dを止めるの失敗した...", build), "danger")
 		return &originalMessage
 	}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/nlopes/slack"
+	"github.com/vivitInc/maguro/config"
+	"github.com/vivitInc/maguro/drone"
+	"github.com/vivitInc/maguro/github"
+	"go.uber.org/zap"
+)
+
+// pendingChangelogs are deploy confirmations waiting for the changelog.
+var pendingChangelogs = &changelogUpdates{pending: map[string]bool{}}
+
+// changelogUpdates drops the changelog if the confirmation has been answered before it is ready.
+// Otherwise the answer would be overwritten by the confirmation.
+type changelogUpdates struct {
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+// add registers the confirmation message by its timestamp.
+func (u *changelogUpdates) add(ts string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.pending[ts] = true
+}
+
+// cancel is called when the confirmation is answered.
+// It waits for the update being posted.
+func (u *changelogUpdates) cancel(ts string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.pending, ts)
+}
+
+// finish calls update if the confirmation is not answered yet.
+func (u *changelogUpdates) finish(ts string, update func()) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.pending[ts] {
+		return
+	}
+	delete(u.pending, ts)
+	update()
+}
+
+// changelogLimit is the number of commits shown in the deploy confirmation.
+const changelogLimit = 10
+
+// pullRequestPattern matches pull request numbers of squash and merge commits.
+// e.g. "Fix typo (#123)", "Merge pull request #123 from owner/branch"
+var pullRequestPattern = regexp.MustCompile(`(\(|Merge pull request )#(\d+)`)
+
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+type changeCommit struct {
+	SHA     string
+	Message string
+	Author  string
+	URL     string
+}
+
+// Changelog is commits between the build deployed to the env and the build to deploy.
+type Changelog struct {
+	// Deployed is nil if no deploy to the env is found in recent builds.
+	Deployed *drone.Build
+	Target   *drone.Build
+	// Rollback is true if Target is older than Deployed.
+	// Commits are the ones to be reverted then.
+	Rollback bool
+	// Commits are sorted by newest first.
+	Commits []changeCommit
+	// Partial is true if older commits may be missing.
+	Partial bool
+	// RepoURL is the web page of the repository. e.g. https://github.com/owner/name
+	RepoURL string
+}
+
+// changelog lists commits by GitHub compare API if configured, otherwise by push builds of drone.
+func (d *Deploy) changelog(repo, env string, number int) (*Changelog, error) {
+	client := d.drone.ForRepo(repo)
+	builds, err := client.GetBuilds(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	cl := &Changelog{}
+	for _, b := range builds {
+		if b.Number == number {
+			cl.Target = b
+		}
+		// builds are sorted by newest first
+		if cl.Deployed == nil && b.Deploy == env && b.Status == "success" && b.Number != number {
+			cl.Deployed = b
+		}
+	}
+	if cl.Target == nil {
+		if cl.Target, err = client.GetBuild(repo, number); err != nil {
+			return nil, err
+		}
+	}
+	conf := d.config.Get()
+	cl.RepoURL = repoURL(repo, cl.Target, conf)
+	if cl.Deployed == nil || cl.Deployed.Sha == cl.Target.Sha {
+		return cl, nil
+	}
+
+	if gh := conf.GitHub; gh != nil {
+		commits, rollback, err := compareCommits(github.NewClient(gh.APIURL, gh.Token), repo, cl.Deployed.Sha, cl.Target.Sha)
+		if err == nil {
+			cl.Commits, cl.Rollback = commits, rollback
+			return cl, nil
+		}
+		githubErrorsTotal.Inc("Compare")
+		logger.Warn("Failed to compare commits", zap.String("repo", repo), zap.String("detail", err.Error()))
+	}
+
+	// The deploy build is a promotion of its parent.
+	deployed := cl.Deployed
+	for _, b := range builds {
+		if b.Number == cl.Deployed.Parent {
+			deployed = b
+			break
+		}
+	}
+	cl.Rollback = cl.Target.Number < deployed.Number
+	if cl.Rollback {
+		cl.Commits, cl.Partial = commitsFromBuilds(builds, cl.Target, deployed)
+	} else {
+		cl.Commits, cl.Partial = commitsFromBuilds(builds, deployed, cl.Target)
+	}
+	return cl, nil
+}
+
+// compareCommits returns commits to deploy newest first.
+// If head is behind base, commits to be reverted are returned with rollback true.
+func compareCommits(client *github.Client, repo, base, head string) ([]changeCommit, bool, error) {
+	cmp, err := client.Compare(repo, base, head)
+	if err != nil {
+		return nil, false, err
+	}
+	rollback := cmp.Status == "behind"
+	if rollback {
+		if cmp, err = client.Compare(repo, head, base); err != nil {
+			return nil, false, err
+		}
+	}
+
+	commits := []changeCommit{}
+	for i := len(cmp.Commits) - 1; i >= 0; i-- {
+		c := cmp.Commits[i]
+		author := c.Author
+		if author == "" {
+			author = c.Name
+		}
+		commits = append(commits, changeCommit{SHA: c.SHA, Message: c.Message, Author: author, URL: c.URL})
+	}
+	return commits, rollback, nil
+}
+
+// commitsFromBuilds lists head commits of push builds on the branch of to back to from.
+// drone knows only head commits of pushes, and the list is partial if the commit of from is not found.
+func commitsFromBuilds(builds []*drone.Build, from, to *drone.Build) ([]changeCommit, bool) {
+	commits := []changeCommit{}
+	seen := map[string]bool{}
+	for _, b := range builds {
+		if b.Number > to.Number {
+			continue
+		}
+		if b.Sha == from.Sha {
+			return commits, false
+		}
+		if b.Branch != to.Branch || (b.Event != "push" && b.Number != to.Number) || seen[b.Sha] {
+			continue
+		}
+		seen[b.Sha] = true
+		commits = append(commits, changeCommit{SHA: b.Sha, Message: b.Message, Author: b.Author, URL: b.Link})
+	}
+	return commits, true
+}
+
+// repoURL returns the web page of the repository from config or the commit link of the build.
+func repoURL(repo string, build *drone.Build, conf *config.Config) string {
+	if conf.GitHub != nil {
+		return strings.TrimSuffix(conf.GitHub.WebURL, "/") + "/" + repo
+	}
+	// e.g. https://github.com/owner/name/commit/{sha}
+	if i := strings.Index(build.Link, "/commit/"); i >= 0 {
+		return build.Link[:i]
+	}
+	return ""
+}
+
+// ChangelogAttachment shows commits to deploy with authors and pull request links.
+func ChangelogAttachment(env string, cl *Changelog) slack.Attachment {
+	attachment := slack.Attachment{
+		MarkdownIn: []string{"text"},
+	}
+	if cl.Deployed == nil {
+		attachment.Text = fmt.Sprintf("最近のビルドに%sへのデプロイが見つからなかったので、変更内容はわからないよ", env)
+		return attachment
+	}
+
+	attachment.Title = fmt.Sprintf("デプロイされる変更 (#%d → #%d)", cl.Deployed.Number, cl.Target.Number)
+	base, head := cl.Deployed.Sha, cl.Target.Sha
+	if cl.Rollback {
+		attachment.Title = fmt.Sprintf("ロールバックで戻される変更 (#%d → #%d)", cl.Deployed.Number, cl.Target.Number)
+		attachment.Color = "warning"
+		base, head = head, base
+	}
+	if cl.RepoURL != "" && cl.Deployed.Sha != cl.Target.Sha {
+		attachment.TitleLink = fmt.Sprintf("%s/compare/%s...%s", cl.RepoURL, base, head)
+	}
+	if len(cl.Commits) == 0 {
+		attachment.Text = fmt.Sprintf("%sにデプロイされているビルドと同じコミットだよ", env)
+		return attachment
+	}
+
+	lines := []string{}
+	for i, c := range cl.Commits {
+		if i == changelogLimit {
+			lines = append(lines, fmt.Sprintf("ほか%d件", len(cl.Commits)-changelogLimit))
+			break
+		}
+		lines = append(lines, commitLine(c, cl.RepoURL))
+	}
+	attachment.Text = strings.Join(lines, "\n")
+	if cl.Partial {
+		attachment.Footer = "droneのビルド履歴から探したので、一部のコミットだけかも"
+	}
+	return attachment
+}
+
+// commitLine formats the commit. Format: {sha} {first line of message} ({author})
+func commitLine(c changeCommit, repoURL string) string {
+	sha := c.SHA
+	if len(sha) > 7 {
+		sha = sha[:7]
+	}
+	if c.URL != "" {
+		sha = fmt.Sprintf("<%s|%s>", c.URL, sha)
+	} else {
+		sha = "`" + sha + "`"
+	}
+
+	message := strings.SplitN(strings.TrimSpace(c.Message), "\n", 2)[0]
+	message = slackEscaper.Replace(message)
+	if repoURL != "" {
+		message = pullRequestPattern.ReplaceAllString(message, fmt.Sprintf("${1}<%s/pull/${2}|#${2}>", repoURL))
+	}
+
+	if c.Author == "" {
+		return fmt.Sprintf("%s %s", sha, message)
+	}
+	return fmt.Sprintf("%s %s (%s)", sha, message, slackEscaper.Replace(c.Author))
+}
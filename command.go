@@ -2,15 +2,16 @@ package main
 
 import (
 	"github.com/nlopes/slack"
+	"github.com/vivitInc/maguro/config"
 	"go.uber.org/zap"
 )
 
-func Tomoka(client *slack.Client, ev *slack.MessageEvent) {
+func Tomoka(client slackClient, conf *config.Config, ev *slack.MessageEvent) {
 	params := slack.PostMessageParameters{
 		Attachments: []slack.Attachment{
 			{
 				Title:    "tomoka",
-				ImageURL: "https://bot.dev.hinata.me/maguro/public/tomoka.png",
+				ImageURL: conf.AssetURL("tomoka.png"),
 			},
 		},
 	}
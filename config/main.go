@@ -3,36 +3,269 @@ package config
 import (
 	"io/ioutil"
 	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 )
 
 type Config struct {
-	Channels     []string     `yaml:"channels"`
-	Repositories []Repository `yaml:"repositories"`
-	Schedules    []Schedule   `yaml:"schedules"`
+	// PublicURL is the externally reachable base URL of maguro.
+	// e.g. https://bot.example.com
+	PublicURL string `yaml:"public_url"`
+	// BuildURL is the URL template of the build page of CI.
+	// {owner}, {name}, {repo} and {number} are replaced.
+	// e.g. https://ci.example.com/{owner}/{name}/{number}
+	BuildURL string `yaml:"build_url"`
+	// Owners limits repositories listed by build command.
+	// All repositories are listed if empty.
+	Owners []string `yaml:"owners"`
+	// Drones are drone servers in addition to DRONE_HOST.
+	Drones       []DroneServer `yaml:"drones"`
+	Channels     []string      `yaml:"channels"`
+	Repositories []Repository  `yaml:"repositories"`
+	Schedules    []Schedule    `yaml:"schedules"`
+	// ScheduleChannel is the channel where results of scheduled jobs are posted.
+	// Results are not posted if empty.
+	ScheduleChannel string `yaml:"schedule_channel"`
+	// Timezone is the time zone of cron of schedules. e.g. Asia/Tokyo
+	// Local time zone is used if empty.
+	Timezone string `yaml:"timezone"`
+	// Subscriptions post failures and recoveries of builds.
+	Subscriptions []Subscription `yaml:"subscriptions"`
+	// Users maps commit authors to Slack users to mention them.
+	// Slack users are matched by email too.
+	Users []User `yaml:"users"`
+	// SlackLoginField is the ID of the custom profile field of Slack
+	// where users write their login of GitHub or Gitea. e.g. Xf0123ABCD
+	SlackLoginField string `yaml:"slack_login_field"`
+	// GitHub enables GitHub API. Commits in the deploy confirmation are listed by compare API.
+	// Commits are listed from drone builds if nil.
+	// Deploys are posted as GitHub Deployments if Token is set.
+	GitHub *GitHub `yaml:"github"`
+}
+
+// GitHub is github.com or GitHub Enterprise.
+// Environment variables in Token are expanded. e.g. ${GITHUB_TOKEN}
+type GitHub struct {
+	// APIURL is https://api.github.com if empty.
+	// e.g. https://github.example.com/api/v3
+	APIURL string `yaml:"api_url"`
+	// WebURL is the base URL of pull request links. https://github.com if empty.
+	WebURL string `yaml:"web_url"`
+	Token  string `yaml:"token"`
+}
+
+// DefaultDroneServer is the name of the drone server given by DRONE_HOST.
+const DefaultDroneServer = "default"
+
+// DroneServer is a drone server.
+// Environment variables in Host and Token are expanded. e.g. ${DRONE_TOKEN}
+type DroneServer struct {
+	Name  string `yaml:"name"`
+	Host  string `yaml:"host"`
+	Token string `yaml:"token"`
+	// Version is the API version of drone. 0.8 or 1 (for 1.x and 2.x).
+	// Detected from the server if empty.
+	Version string `yaml:"version"`
+	// BuildURL overrides Config.BuildURL for repositories on this server.
+	// {host}/{repo}/{number} is used if empty.
+	BuildURL string `yaml:"build_url"`
 }
 
 type Repository struct {
-	Name string   `yaml:"name"`
-	Env  []string `yaml:"env"`
+	Name string `yaml:"name"`
+	// Drone is the name of drone server. The default server is used if empty.
+	Drone string   `yaml:"drone"`
+	Env   []string `yaml:"env"`
 }
 
+// Subscription posts to Channel when a build on Branches of Repo fails or recovers.
+type Subscription struct {
+	Repo string `yaml:"repo"`
+	// Branches are master if empty.
+	Branches []string `yaml:"branches"`
+	Channel  string   `yaml:"channel"`
+}
+
+// User is a Slack user and the account of VCS.
+type User struct {
+	// Slack is the Slack user ID. e.g. U90LAKZM0
+	Slack string `yaml:"slack"`
+	// Login is the login name of GitHub or Gitea.
+	Login string `yaml:"login"`
+	Email string `yaml:"email"`
+}
+
+const (
+	// ScheduleRestartLatestOnBranch restarts the latest succeeded build on Branch of Repo.
+	ScheduleRestartLatestOnBranch = "restart-latest-on-branch"
+	// ScheduleDeployBuildToEnv deploys the latest succeeded build on Branch of Repo to Env.
+	ScheduleDeployBuildToEnv = "deploy-build-to-env"
+	// ScheduleTriggerBranchBuild starts a new build of Branch of Repo.
+	ScheduleTriggerBranchBuild = "trigger-branch-build"
+	// SchedulePostStatusReport posts the latest builds of Repos to Channel.
+	SchedulePostStatusReport = "post-status-report"
+)
+
 type Schedule struct {
 	Name string `yaml:"name"`
+	// Type is one of Schedule* constants. ScheduleRestartLatestOnBranch if empty.
+	Type string `yaml:"type"`
 	Cron string `yaml:"cron"`
+	// Timezone overrides Config.Timezone.
+	Timezone string `yaml:"timezone"`
+	// Drone is the name of drone server. The server of Repo is used if empty.
+	Drone string `yaml:"drone"`
+	// Repo is the target repository. Name is used if empty.
+	Repo string `yaml:"repo"`
+	// Branch is master if empty.
+	Branch string `yaml:"branch"`
+	// Status are statuses of the build to restart or deploy. success if empty.
+	Status []string `yaml:"status"`
+	Env    string   `yaml:"env"`
+	// Repos are reported by SchedulePostStatusReport. All repositories if empty.
+	Repos   []string `yaml:"repos"`
+	Channel string   `yaml:"channel"`
+	// ReportChannel overrides Config.ScheduleChannel.
+	ReportChannel string `yaml:"report_channel"`
 }
 
-func LoadConfig() (*Config, error) {
-	buf, err := ioutil.ReadFile("./config.yaml")
+// LoadConfig reads the config file at path.
+func LoadConfig(path string) (*Config, error) {
+	buf, err := ioutil.ReadFile(path)
 	if err != nil {
 		log.Printf("failed read config file: %s", err)
 		return nil, err
 	}
-	var config Config
-	if err = yaml.Unmarshal(buf, &config); err != nil {
+	config, err := ParseConfig(buf)
+	if err != nil {
 		log.Printf("failed read config file: %s", err)
 		return nil, err
 	}
+	return config, nil
+}
+
+// ParseConfig decodes and validates config.
+// Unknown fields are errors to find typos.
+func ParseConfig(buf []byte) (*Config, error) {
+	var config Config
+	if err := yaml.UnmarshalStrict(buf, &config); err != nil {
+		return nil, err
+	}
+	for i := range config.Schedules {
+		config.Schedules[i].setDefaults()
+	}
+	for i := range config.Subscriptions {
+		if len(config.Subscriptions[i].Branches) == 0 {
+			config.Subscriptions[i].Branches = []string{"master"}
+		}
+	}
+	if config.GitHub != nil {
+		if config.GitHub.APIURL == "" {
+			config.GitHub.APIURL = "https://api.github.com"
+		}
+		if config.GitHub.WebURL == "" {
+			config.GitHub.WebURL = "https://github.com"
+		}
+	}
+	// Validate before expanding so that the file can be checked without the environment variables.
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	for i := range config.Drones {
+		config.Drones[i].Host = os.ExpandEnv(config.Drones[i].Host)
+		config.Drones[i].Token = os.ExpandEnv(config.Drones[i].Token)
+	}
+	if config.GitHub != nil {
+		config.GitHub.Token = os.ExpandEnv(config.GitHub.Token)
+	}
 	return &config, nil
 }
+
+// Store holds the current config. The config is replaced as a whole on reload,
+// so callers should Get it once per request and not keep it.
+type Store struct {
+	v atomic.Value
+}
+
+func NewStore(c *Config) *Store {
+	s := &Store{}
+	s.Set(c)
+	return s
+}
+
+func (s *Store) Get() *Config {
+	return s.v.Load().(*Config)
+}
+
+func (s *Store) Set(c *Config) {
+	s.v.Store(c)
+}
+
+// Location returns the time zone of Timezone.
+func (c *Config) Location() (*time.Location, error) {
+	if c.Timezone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(c.Timezone)
+}
+
+// AssetURL returns the URL of a file served under /maguro/public.
+func (c *Config) AssetURL(name string) string {
+	return strings.TrimSuffix(c.PublicURL, "/") + "/maguro/public/" + name
+}
+
+// BuildLink returns the URL of the build page of CI.
+// repo format: {owner}/{name}
+func (c *Config) BuildLink(repo string, number int) string {
+	owner, name := repo, ""
+	if i := strings.Index(repo, "/"); i >= 0 {
+		owner, name = repo[:i], repo[i+1:]
+	}
+	r := strings.NewReplacer(
+		"{owner}", owner,
+		"{name}", name,
+		"{repo}", repo,
+		"{number}", strconv.Itoa(number),
+	)
+	return r.Replace(c.buildURL(repo))
+}
+
+func (c *Config) buildURL(repo string) string {
+	server := ""
+	for _, r := range c.Repositories {
+		if r.Name == repo {
+			server = r.Drone
+			break
+		}
+	}
+	for _, d := range c.Drones {
+		if d.Name != server {
+			continue
+		}
+		if d.BuildURL != "" {
+			return d.BuildURL
+		}
+		return strings.TrimSuffix(d.Host, "/") + "/{repo}/{number}"
+	}
+	return c.BuildURL
+}
+
+func (s *Schedule) setDefaults() {
+	if s.Type == "" {
+		s.Type = ScheduleRestartLatestOnBranch
+	}
+	if s.Repo == "" && s.Type != SchedulePostStatusReport {
+		s.Repo = s.Name
+	}
+	if s.Branch == "" {
+		s.Branch = "master"
+	}
+	if len(s.Status) == 0 {
+		s.Status = []string{"success"}
+	}
+}
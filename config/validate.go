@@ -0,0 +1,202 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+// channelIDPattern matches Slack public and private channel IDs. e.g. CA88ED2AK
+var channelIDPattern = regexp.MustCompile(`^[CG][A-Z0-9]{6,}$`)
+
+// userIDPattern matches Slack user IDs. e.g. U90LAKZM0
+var userIDPattern = regexp.MustCompile(`^[UW][A-Z0-9]{6,}$`)
+
+// Validate checks values which yaml decoding can't check.
+// All problems are reported at once.
+func (c *Config) Validate() error {
+	errs := []string{}
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if c.Timezone != "" {
+		if _, err := time.LoadLocation(c.Timezone); err != nil {
+			add("timezone: invalid timezone %s", c.Timezone)
+		}
+	}
+	for _, ch := range c.Channels {
+		if !channelIDPattern.MatchString(ch) {
+			add("channels: %s is not a channel ID", ch)
+		}
+	}
+	if c.ScheduleChannel != "" && !channelIDPattern.MatchString(c.ScheduleChannel) {
+		add("schedule_channel: %s is not a channel ID", c.ScheduleChannel)
+	}
+
+	// The default server is given by DRONE_HOST.
+	drones := map[string]bool{DefaultDroneServer: true}
+	versions := map[string]string{}
+	for i, d := range c.Drones {
+		switch {
+		case d.Name == "":
+			add("drones[%d]: name is required", i)
+		case drones[d.Name]:
+			add("drones[%d]: duplicated name %s", i, d.Name)
+		}
+		drones[d.Name] = true
+		versions[d.Name] = d.Version
+		if d.Host == "" {
+			add("drones[%d]: host is required", i)
+		}
+		if d.Version != "" && d.Version != "0.8" && d.Version != "1" {
+			add("drones[%d]: version must be 0.8 or 1", i)
+		}
+	}
+
+	repos := map[string]bool{}
+	repoDrones := map[string]string{}
+	for i, r := range c.Repositories {
+		if err := validateRepoName(r.Name); err != nil {
+			add("repositories[%d]: %s", i, err)
+		}
+		if repos[r.Name] {
+			add("repositories[%d]: duplicated name %s", i, r.Name)
+		}
+		repos[r.Name] = true
+		repoDrones[r.Name] = r.Drone
+		if r.Drone != "" && !drones[r.Drone] {
+			add("repositories[%d]: %s: unknown drone %s", i, r.Name, r.Drone)
+		}
+		if len(r.Env) == 0 {
+			add("repositories[%d]: %s: env is required", i, r.Name)
+		}
+		envs := map[string]bool{}
+		for _, e := range r.Env {
+			if e == "" || strings.ContainsAny(e, ": ") {
+				add("repositories[%d]: %s: invalid env %q", i, r.Name, e)
+			}
+			if envs[e] {
+				add("repositories[%d]: %s: duplicated env %s", i, r.Name, e)
+			}
+			envs[e] = true
+		}
+	}
+
+	schedules := map[string]bool{}
+	for i, s := range c.Schedules {
+		if err := s.Validate(); err != nil {
+			add("schedules[%d]: %s", i, err)
+		}
+		if s.Drone != "" && !drones[s.Drone] {
+			add("schedules[%d]: %s: unknown drone %s", i, s.Name, s.Drone)
+		}
+		server := s.Drone
+		if server == "" {
+			server = repoDrones[s.Repo]
+		}
+		// drone 0.8 has no API to create a build.
+		if s.Type == ScheduleTriggerBranchBuild && versions[server] == "0.8" {
+			add("schedules[%d]: %s: %s is not supported by drone 0.8 (%s)", i, s.Name, s.Type, server)
+		}
+		if s.Name != "" && schedules[s.Name] {
+			add("schedules[%d]: duplicated name %s", i, s.Name)
+		}
+		schedules[s.Name] = true
+	}
+
+	for i, s := range c.Subscriptions {
+		if err := validateRepoName(s.Repo); err != nil {
+			add("subscriptions[%d]: %s", i, err)
+		}
+		if !channelIDPattern.MatchString(s.Channel) {
+			add("subscriptions[%d]: %s is not a channel ID", i, s.Channel)
+		}
+	}
+
+	for i, u := range c.Users {
+		if !userIDPattern.MatchString(u.Slack) {
+			add("users[%d]: %s is not a user ID", i, u.Slack)
+		}
+		if u.Login == "" && u.Email == "" {
+			add("users[%d]: login or email is required", i)
+		}
+	}
+
+	if c.GitHub != nil {
+		if !isHTTPURL(c.GitHub.APIURL) {
+			add("github: api_url: %s is not a http(s) URL", c.GitHub.APIURL)
+		}
+		if !isHTTPURL(c.GitHub.WebURL) {
+			add("github: web_url: %s is not a http(s) URL", c.GitHub.WebURL)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// Validate checks the schedule. Defaults must be set before.
+func (s *Schedule) Validate() error {
+	if s.Name == "" {
+		return errors.New("schedule name is required")
+	}
+	if s.Timezone != "" {
+		if _, err := time.LoadLocation(s.Timezone); err != nil {
+			return fmt.Errorf("%s: invalid timezone %s: %s", s.Name, s.Timezone, err)
+		}
+	}
+	if _, err := cron.Parse(s.Cron); err != nil {
+		return fmt.Errorf("%s: invalid cron %s: %s", s.Name, s.Cron, err)
+	}
+	for _, ch := range []string{s.Channel, s.ReportChannel} {
+		if ch != "" && !channelIDPattern.MatchString(ch) {
+			return fmt.Errorf("%s: %s is not a channel ID", s.Name, ch)
+		}
+	}
+
+	switch s.Type {
+	case ScheduleRestartLatestOnBranch, ScheduleTriggerBranchBuild:
+	case ScheduleDeployBuildToEnv:
+		if s.Env == "" {
+			return fmt.Errorf("%s: env is required by %s", s.Name, s.Type)
+		}
+	case SchedulePostStatusReport:
+		if s.Channel == "" {
+			return fmt.Errorf("%s: channel is required by %s", s.Name, s.Type)
+		}
+		for _, r := range s.Repos {
+			if err := validateRepoName(r); err != nil {
+				return fmt.Errorf("%s: %s", s.Name, err)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("%s: unknown schedule type %s", s.Name, s.Type)
+	}
+
+	if err := validateRepoName(s.Repo); err != nil {
+		return fmt.Errorf("%s: %s", s.Name, err)
+	}
+	return nil
+}
+
+func validateRepoName(name string) error {
+	strs := strings.Split(name, "/")
+	if len(strs) != 2 || strs[0] == "" || strs[1] == "" {
+		return fmt.Errorf("repository %q must be {owner}/{name}", name)
+	}
+	return nil
+}
+
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
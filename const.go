@@ -1,10 +1,50 @@
 package main
 
+import (
+	"time"
+
+	"github.com/vivitInc/maguro/config"
+)
+
+// defaultDroneServer is the name of drone server given by DRONE_HOST.
+const defaultDroneServer = config.DefaultDroneServer
+
+const (
+	leaderLeaseDuration = 15 * time.Second
+	leaderRetryPeriod   = 5 * time.Second
+	// leaderWaitTimeout is how long a request waits for a leader to forward to.
+	// Slack drops interactions not answered in 3 seconds.
+	leaderWaitTimeout  = 2 * time.Second
+	leaderPollInterval = 100 * time.Millisecond
+)
+
+const (
+	// deployPollInterval is the interval of polling a deploy build without webhook.
+	deployPollInterval = 5 * time.Second
+	// webhookTimeout is how long a deploy watcher waits for a webhook before polling drone.
+	webhookTimeout = 1 * time.Minute
+	// deployRetryLimit is how long a deploy watcher retries failing drone requests
+	// before giving up the deploy and starting the next queued one.
+	deployRetryLimit = 10 * time.Minute
+	// webhookMaxBytes is the limit of a webhook body. drone sends a build with its stages.
+	webhookMaxBytes = 1 << 20
+)
+
+// Documents in statestore.Store
+const (
+	watchesState   = "watches.json"
+	queueState     = "queue.json"
+	deploysState   = "deploys.json"
+	schedulesState = "schedules.json"
+	buildsState    = "builds.json"
+)
+
 const (
 	DeployActionSelectRepo  = "deploy_action_select_repo"
 	DeployActionSelectEnv   = "deploy_action_select_env"
 	DeployActionSelectBuild = "deploy_action_select_build"
 	DeployActionConfirm     = "deploy_action_confirm"
+	DeployActionSchedule    = "deploy_action_schedule"
 	BuildActionSelectRepo   = "build_action_select_repo"
 	BuildActionSelectBuild  = "build_action_select_build"
 	BuildActionRestart      = "build_action_restart"
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -12,15 +13,24 @@ import (
 	"github.com/nlopes/slack"
 	"github.com/vivitInc/maguro/config"
 	"github.com/vivitInc/maguro/drone"
+	"github.com/vivitInc/maguro/github"
 	"go.uber.org/zap"
 )
 
 type Deploy struct {
-	slack  *slack.Client
-	drone  *drone.Drone
-	config *config.Config
+	slack slackClient
+	drone *drone.Servers
+	// config is read on each use because watches and queued deploys outlive config reloads.
+	config  *config.Store
+	deploys *DeployScheduler
+	watcher *DeployWatcher
+	events  *BuildEvents
+	users   *UserDirectory
+	queue   *DeployQueue
 }
 
+const deployTimeFormat = "2006-01-02 15:04 MST"
+
 func DeployAttachmentFields(name, env string, build, target string) []slack.AttachmentField {
 	return []slack.AttachmentField{
 		slack.AttachmentField{
@@ -46,8 +56,71 @@ func DeployAttachmentFields(name, env string, build, target string) []slack.Atta
 	}
 }
 
-func (d *Deploy) SelectRepo(event *slack.MessageEvent) {
-	repos := d.config.Repositories
+// requesterField shows who requested the deploy.
+func (d *Deploy) requesterField(user string) slack.AttachmentField {
+	return slack.AttachmentField{
+		Title: "デプロイする人",
+		Value: d.users.Describe(user),
+		Short: true,
+	}
+}
+
+// Handle runs deploy command.
+// Format: deploy [at [{YYYY-MM-DD}] {HH:MM}] | deploy list | deploy cancel {id}
+func (d *Deploy) Handle(event *slack.MessageEvent, args []string) {
+	if len(args) == 0 {
+		d.SelectRepo(event, time.Time{})
+		return
+	}
+
+	switch args[0] {
+	case "at":
+		loc, err := d.config.Get().Location()
+		if err != nil {
+			d.post(event.Channel, Message(fmt.Sprintf("タイムゾーンの設定がおかしいよ！\n%s", err), "danger"))
+			return
+		}
+		at, err := parseDeployTime(args[1:], time.Now(), loc)
+		if err != nil {
+			d.post(event.Channel, Message(fmt.Sprintf("時間はHH:MMかYYYY-MM-DD HH:MMで指定してね！\n%s", err), "danger"))
+			return
+		}
+		d.SelectRepo(event, at)
+	case "list":
+		d.list(event.Channel)
+	case "cancel":
+		if len(args) < 2 {
+			d.post(event.Channel, Message("キャンセルする予約のIDを指定してね！", "danger"))
+			return
+		}
+		if strings.HasPrefix(args[1], queuedDeployPrefix) {
+			qd, err := d.queue.Cancel(args[1])
+			if err != nil {
+				d.post(event.Channel, Message(fmt.Sprintf("キャンセルできなかった...\n%s", err), "danger"))
+				return
+			}
+			attachments := Message(fmt.Sprintf("順番待ち%sをキャンセルしたよ！", qd.ID), "good")
+			attachments[0].Fields = DeployAttachmentFields(qd.Repo, qd.Env, strconv.Itoa(qd.Number), "")
+			d.post(event.Channel, attachments)
+			return
+		}
+		sd, err := d.deploys.Cancel(args[1])
+		if err != nil {
+			d.post(event.Channel, Message(fmt.Sprintf("キャンセルできなかった...\n%s", err), "danger"))
+			return
+		}
+		attachments := Message(fmt.Sprintf("予約%sをキャンセルしたよ！", sd.ID), "good")
+		attachments[0].Fields = DeployAttachmentFields(sd.Repo, sd.Env, strconv.Itoa(sd.Number), "")
+		d.post(event.Channel, attachments)
+	default:
+		d.post(event.Channel, Message("deploy, deploy at HH:MM, deploy list, deploy cancel IDのどれかで呼んでね！", "danger"))
+	}
+}
+
+// SelectRepo starts deploy conversation.
+// The time is kept in callback ID if the deploy is scheduled.
+func (d *Deploy) SelectRepo(event *slack.MessageEvent, at time.Time) {
+	repos := d.config.Get().Repositories
 	options := make([]slack.AttachmentActionOption, len(repos))
 	for i, repo := range repos {
 		options[i] = slack.AttachmentActionOption{
@@ -56,11 +129,18 @@ func (d *Deploy) SelectRepo(event *slack.MessageEvent) {
 		}
 	}
 
+	text := "どのリポジトリにする？"
+	callbackID := "deploy"
+	if !at.IsZero() {
+		text = fmt.Sprintf("%sに予約するよ。どのリポジトリにする？", at.Format(deployTimeFormat))
+		callbackID = fmt.Sprintf("deploy@%d", at.Unix())
+	}
+
 	params := slack.PostMessageParameters{
 		Attachments: []slack.Attachment{
 			slack.Attachment{
-				Text:       "どのリポジトリにする？",
-				CallbackID: "deploy",
+				Text:       text,
+				CallbackID: callbackID,
 				Fields:     DeployAttachmentFields("", "", "", ""),
 				Actions: []slack.AttachmentAction{
 					SelectMenu(DeployActionSelectRepo, options),
@@ -82,7 +162,7 @@ func (d *Deploy) SelectEnv(message *slack.AttachmentActionCallback) *slack.Messa
 	value := message.Actions[0].SelectedOptions[0].Value
 	var repo *config.Repository
 	repo = nil
-	for _, r := range d.config.Repositories {
+	for _, r := range d.config.Get().Repositories {
 		if r.Name == value {
 			repo = &r
 			break
@@ -116,8 +196,7 @@ func (d *Deploy) SelectBuild(message *slack.AttachmentActionCallback) *slack.Mes
 
 	// Format: {owner}/{repo}:{env}
 	strs := strings.Split(message.Actions[0].SelectedOptions[0].Value, ":")
-	repo := drone.GetRepoFromFullName(strs[0])
-	builds, err := d.drone.GetSucceededBuilds(repo)
+	builds, err := d.drone.ForRepo(strs[0]).GetSucceededBuilds(strs[0])
 	if err != nil {
 		logger.Error("Failed to get succeeded builds", zap.String("detail", err.Error()))
 		originalMessage.Attachments = Message("デプロイできる環境が見つからないよ！", "danger")
@@ -128,12 +207,12 @@ func (d *Deploy) SelectBuild(message *slack.AttachmentActionCallback) *slack.Mes
 	for i, build := range builds {
 		options[i] = slack.AttachmentActionOption{
 			Text:  fmt.Sprintf("%d: %s %s", build.Number, build.Commit, build.Message),
-			Value: fmt.Sprintf("%s:%s:%d", repo.FullName(), strs[1], build.Number),
+			Value: fmt.Sprintf("%s:%s:%d", strs[0], strs[1], build.Number),
 		}
 	}
 
-	originalMessage.Attachments[0].Text = fmt.Sprintf("%sのどのビルド？", repo.FullName())
-	originalMessage.Attachments[0].Fields = DeployAttachmentFields(repo.FullName(), strs[1], "", "")
+	originalMessage.Attachments[0].Text = fmt.Sprintf("%sのどのビルド？", strs[0])
+	originalMessage.Attachments[0].Fields = DeployAttachmentFields(strs[0], strs[1], "", "")
 	originalMessage.Attachments[0].Actions = []slack.AttachmentAction{
 		SelectMenu(DeployActionSelectBuild, options),
 		CancelButton(),
@@ -148,14 +227,296 @@ func (d *Deploy) Confirm(message *slack.AttachmentActionCallback) *slack.Message
 
 	originalMessage := message.OriginalMessage
 	originalMessage.Attachments[0].Text = "デプロイしていい？"
-	originalMessage.Attachments[0].Fields = DeployAttachmentFields(strs[0], strs[1], strs[2], "")
+	originalMessage.Attachments[0].Fields = append(
+		DeployAttachmentFields(strs[0], strs[1], strs[2], ""),
+		d.requesterField(message.User.ID),
+	)
 	originalMessage.Attachments[0].Actions = []slack.AttachmentAction{
 		PrimaryButton(DeployActionConfirm, "デプロイ", value),
-		CancelButton(),
 	}
+	if at := d.scheduledAt(message); !at.IsZero() {
+		originalMessage.Attachments[0].Actions = append(
+			originalMessage.Attachments[0].Actions,
+			PrimaryButton(DeployActionSchedule, fmt.Sprintf("%sに予約", at.Format(deployTimeFormat)), value),
+		)
+	}
+	originalMessage.Attachments[0].Actions = append(originalMessage.Attachments[0].Actions, CancelButton())
+	originalMessage.Attachments = append(originalMessage.Attachments[:1], slack.Attachment{Text: "変更内容を調べてるよ..."})
+
+	// drone and GitHub may not answer in 3 seconds which Slack waits for the response.
+	updated := originalMessage
+	updated.Attachments = append([]slack.Attachment{}, originalMessage.Attachments...)
+	updated.ReplaceOriginal = true
+	pendingChangelogs.add(message.MessageTs)
+	go func() {
+		attachment := d.changelogAttachment(strs[0], strs[1], strs[2])
+		pendingChangelogs.finish(message.MessageTs, func() {
+			updated.Attachments[1] = attachment
+			if err := postResponse(message.ResponseURL, &updated); err != nil {
+				slackErrorsTotal.Inc("response_url")
+				logger.Warn("Failed to post changelog", zap.String("detail", err.Error()))
+			}
+		})
+	}()
 	return &originalMessage
 }
 
+// changelogAttachment shows commits to deploy. Failures are shown in it not to block the deploy.
+func (d *Deploy) changelogAttachment(repo, env, number string) slack.Attachment {
+	n, err := strconv.Atoi(number)
+	if err == nil {
+		var cl *Changelog
+		if cl, err = d.changelog(repo, env, n); err == nil {
+			return ChangelogAttachment(env, cl)
+		}
+	}
+	logger.Warn("Failed to get changelog", zap.String("repo", repo), zap.String("detail", err.Error()))
+	return slack.Attachment{Text: "変更内容を取れなかった..."}
+}
+
+// scheduledAt returns the time kept in callback ID. Zero if not scheduled.
+// Format: deploy@{unix time}
+func (d *Deploy) scheduledAt(message *slack.AttachmentActionCallback) time.Time {
+	strs := strings.SplitN(message.CallbackID, "@", 2)
+	if len(strs) != 2 {
+		return time.Time{}
+	}
+	sec, err := strconv.ParseInt(strs[1], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	t := time.Unix(sec, 0)
+	if loc, err := d.config.Get().Location(); err == nil {
+		t = t.In(loc)
+	}
+	return t
+}
+
+// Schedule reserves the deploy at the time kept in callback ID.
+func (d *Deploy) Schedule(message *slack.AttachmentActionCallback) *slack.Message {
+	originalMessage := message.OriginalMessage
+	originalMessage.Attachments = Message("予約に失敗したみたい...", "danger")
+
+	// Format: {owner}/{owner}:{env}:{number}
+	strs := strings.Split(message.Actions[0].Value, ":")
+	number, err := strconv.Atoi(strs[2])
+	if err != nil {
+		logger.Error("Failed to schedule deploy", zap.String("detail", err.Error()))
+		return &originalMessage
+	}
+	at := d.scheduledAt(message)
+	if at.IsZero() {
+		logger.Error("Failed to schedule deploy", zap.String("callback_id", message.CallbackID))
+		return &originalMessage
+	}
+
+	sd, err := d.deploys.Add(ScheduledDeploy{
+		Repo:    strs[0],
+		Env:     strs[1],
+		Number:  number,
+		At:      at,
+		Channel: message.Channel.ID,
+		User:    message.User.ID,
+	})
+	if err != nil {
+		logger.Error("Failed to schedule deploy", zap.String("detail", err.Error()))
+		return &originalMessage
+	}
+
+	originalMessage.Attachments = Message(
+		fmt.Sprintf("%sにデプロイするよ！\nやめるときは deploy cancel %s してね。", at.Format(deployTimeFormat), sd.ID),
+		"good",
+	)
+	originalMessage.Attachments[0].Fields = append(
+		DeployAttachmentFields(strs[0], strs[1], strs[2], ""),
+		d.requesterField(message.User.ID),
+	)
+	return &originalMessage
+}
+
+// RunScheduled deploys the scheduled deploy and notices the result to its channel.
+// The deploy is queued if another deploy of the env is running.
+func (d *Deploy) RunScheduled(sd ScheduledDeploy) {
+	qd, ok, err := d.queue.Acquire(QueuedDeploy{
+		Repo:    sd.Repo,
+		Env:     sd.Env,
+		Number:  sd.Number,
+		User:    sd.User,
+		Channel: sd.Channel,
+	})
+	if err != nil {
+		logger.Error("Failed to queue deploy", zap.String("detail", err.Error()))
+		attachments := Message(fmt.Sprintf("予約%sのデプロイに失敗したみたい...\n%s", sd.ID, err), "danger")
+		attachments[0].Fields = append(DeployAttachmentFields(sd.Repo, sd.Env, strconv.Itoa(sd.Number), ""), d.requesterField(sd.User))
+		d.post(sd.Channel, attachments)
+		return
+	}
+	if !ok {
+		attachments := d.queuedAttachments(qd)
+		attachments[0].Title = fmt.Sprintf("予約%sのデプロイ", sd.ID)
+		d.post(sd.Channel, attachments)
+		return
+	}
+	d.deployInChannel(qd, fmt.Sprintf("予約%sの", sd.ID))
+}
+
+// RunSchedule deploys the build by the schedule through the queue as deploys requested in Slack.
+// The build is nil if the deploy waits for the running one.
+func (d *Deploy) RunSchedule(s config.Schedule, number int) (*drone.Build, error) {
+	channel := s.ReportChannel
+	if channel == "" {
+		channel = d.config.Get().ScheduleChannel
+	}
+	qd, ok, err := d.queue.Acquire(QueuedDeploy{
+		Repo:    s.Repo,
+		Env:     s.Env,
+		Number:  number,
+		Channel: channel,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if channel != "" {
+			attachments := d.queuedAttachments(qd)
+			attachments[0].Title = fmt.Sprintf("スケジュール「%s」のデプロイ", s.Name)
+			d.post(channel, attachments)
+		}
+		return nil, nil
+	}
+	return d.startQueued(qd, fmt.Sprintf("スケジュール「%s」の", s.Name))
+}
+
+// runQueued deploys the queued deploy whose turn has come.
+func (d *Deploy) runQueued(qd QueuedDeploy) {
+	logger.Info("Run queued deploy", zap.String("id", qd.ID), zap.String("repo", qd.Repo), zap.String("env", qd.Env))
+	label := fmt.Sprintf("順番待ち%sの", qd.ID)
+	if qd.User != "" {
+		label = fmt.Sprintf("<@%s> %s", qd.User, label)
+	}
+	d.deployInChannel(qd, label)
+}
+
+// next starts the next queued deploy of the env after the running one finishes.
+func (d *Deploy) next(repo, env string) {
+	qd, ok, err := d.queue.Release(repo, env)
+	if err != nil {
+		logger.Error("Failed to save queued deploys", zap.String("detail", err.Error()))
+	}
+	if ok {
+		d.runQueued(qd)
+	}
+}
+
+// deployInChannel deploys the build which has been marked running in the queue
+// and posts to its channel instead of the interactive message.
+// label is the prefix of the posted text. e.g. 予約1の
+func (d *Deploy) deployInChannel(qd QueuedDeploy, label string) {
+	if _, err := d.startQueued(qd, label); err != nil {
+		attachments := Message(fmt.Sprintf("%sデプロイに失敗したみたい...\n%s", label, err), "danger")
+		attachments[0].Fields = append(DeployAttachmentFields(qd.Repo, qd.Env, strconv.Itoa(qd.Number), ""), d.requesterField(qd.User))
+		d.post(qd.Channel, attachments)
+	}
+}
+
+// startQueued deploys the build which has been marked running in the queue and watches it.
+// The start is posted to the channel if any, and the result is posted to its thread.
+// The next queued deploy starts if the deploy fails to start.
+func (d *Deploy) startQueued(qd QueuedDeploy, label string) (*drone.Build, error) {
+	from := strconv.Itoa(qd.Number)
+	build, err := d.drone.ForRepo(qd.Repo).Deploy(qd.Repo, qd.Number, qd.Env, map[string]string{})
+	if err != nil {
+		deploysTotal.Inc(qd.Repo, qd.Env, "error")
+		logger.Error("Failed to deploy", zap.String("detail", err.Error()))
+		d.next(qd.Repo, qd.Env)
+		return nil, err
+	}
+	deploysTotal.Inc(qd.Repo, qd.Env, "started")
+	buildNumber := strconv.Itoa(build.Number)
+
+	ts := ""
+	if qd.Channel != "" {
+		attachments := Message(fmt.Sprintf(`%sデプロイ始めたよ！
+	デプロイ状況はここから見てね。
+	 -> %s
+	`, label, d.config.Get().BuildLink(qd.Repo, build.Number)), "warning")
+		attachments[0].Fields = append(DeployAttachmentFields(qd.Repo, qd.Env, from, buildNumber), d.requesterField(qd.User))
+		if _, ts, err = d.slack.PostMessage(qd.Channel, "", slack.PostMessageParameters{Attachments: attachments}); err != nil {
+			logger.Error("Failed to post message", zap.String("detail", err.Error()))
+		}
+	}
+
+	d.watcher.Watch(deployWatch{
+		Repo:      qd.Repo,
+		Env:       qd.Env,
+		From:      from,
+		Build:     buildNumber,
+		Channel:   qd.Channel,
+		ThreadTs:  ts,
+		User:      qd.User,
+		StartedAt: time.Now(),
+	}, d.notice)
+	return build, nil
+}
+
+// queuedAttachments shows who is deploying what while the deploy waits.
+func (d *Deploy) queuedAttachments(qd QueuedDeploy) []slack.Attachment {
+	text := "デプロイ中のビルドがあるよ。"
+	if running, ok := d.queue.Running(qd.Repo, qd.Env); ok {
+		text = fmt.Sprintf("%sが#%sを%sにデプロイ中だよ。", d.users.Describe(running.User), running.From, running.Env)
+	}
+	attachments := Message(fmt.Sprintf(
+		"%s\n終わったら自動でデプロイするね！ (%d番目)\nやめるときは deploy cancel %s してね。",
+		text, d.queue.Position(qd), qd.ID,
+	), "warning")
+	attachments[0].Fields = append(DeployAttachmentFields(qd.Repo, qd.Env, strconv.Itoa(qd.Number), ""), d.requesterField(qd.User))
+	return attachments
+}
+
+// list shows running, queued and scheduled deploys.
+func (d *Deploy) list(channel string) {
+	running, queued := d.queue.List()
+	scheduled := d.deploys.List()
+	if len(running)+len(queued)+len(scheduled) == 0 {
+		d.post(channel, Message("デプロイ中、順番待ち、予約のデプロイはないよ！", ""))
+		return
+	}
+
+	attachments := []slack.Attachment{}
+	for _, r := range running {
+		attachments = append(attachments, slack.Attachment{
+			Title:  "デプロイ中",
+			Text:   fmt.Sprintf("%sが%sから", d.users.Describe(r.User), r.StartedAt.Format(deployTimeFormat)),
+			Fields: DeployAttachmentFields(r.Repo, r.Env, r.From, ""),
+			Color:  "warning",
+		})
+	}
+	for _, qd := range queued {
+		attachments = append(attachments, slack.Attachment{
+			Title:  fmt.Sprintf("%s: 順番待ち", qd.ID),
+			Text:   fmt.Sprintf("%sが%sに依頼", d.users.Describe(qd.User), qd.QueuedAt.Format(deployTimeFormat)),
+			Fields: DeployAttachmentFields(qd.Repo, qd.Env, strconv.Itoa(qd.Number), ""),
+		})
+	}
+	for _, sd := range scheduled {
+		attachments = append(attachments, slack.Attachment{
+			Title:  fmt.Sprintf("%s: %s", sd.ID, sd.At.Format(deployTimeFormat)),
+			Text:   fmt.Sprintf("%sが予約", d.users.Describe(sd.User)),
+			Fields: DeployAttachmentFields(sd.Repo, sd.Env, strconv.Itoa(sd.Number), ""),
+		})
+	}
+	d.post(channel, attachments)
+}
+
+func (d *Deploy) post(channel string, attachments []slack.Attachment) {
+	params := slack.PostMessageParameters{
+		Attachments: attachments,
+	}
+	if _, _, err := d.slack.PostMessage(channel, "", params); err != nil {
+		logger.Error("Failed to post message", zap.String("detail", err.Error()))
+	}
+}
+
 func (d *Deploy) Deploy(message *slack.AttachmentActionCallback) *slack.Message {
 	originalMessage := message.OriginalMessage
 	originalMessage.Attachments = Message(fmt.Sprintf("デプロイに失敗したみたい..."), "danger")
@@ -164,93 +525,223 @@ func (d *Deploy) Deploy(message *slack.AttachmentActionCallback) *slack.Message
 	value := message.Actions[0].Value
 	strs := strings.Split(value, ":")
 
-	repo := drone.GetRepoFromFullName(strs[0])
 	number, err := strconv.Atoi(strs[2])
 	if err != nil {
 		logger.Error("Failed to deploy", zap.String("detail", err.Error()))
 		return &originalMessage
 	}
 
-	build, err := d.drone.Deploy(*repo, number, strs[1], map[string]string{})
-	buildNumber := strconv.Itoa(build.Number)
+	qd, ok, err := d.queue.Acquire(QueuedDeploy{
+		Repo:    strs[0],
+		Env:     strs[1],
+		Number:  number,
+		User:    message.User.ID,
+		Channel: message.Channel.ID,
+	})
 	if err != nil {
+		logger.Error("Failed to queue deploy", zap.String("detail", err.Error()))
+		return &originalMessage
+	}
+	if !ok {
+		originalMessage.Attachments = d.queuedAttachments(qd)
+		return &originalMessage
+	}
+
+	build, err := d.drone.ForRepo(strs[0]).Deploy(strs[0], number, strs[1], map[string]string{})
+	if err != nil {
+		deploysTotal.Inc(strs[0], strs[1], "error")
 		logger.Error("Failed to deploy", zap.String("detail", err.Error()))
+		go d.next(strs[0], strs[1])
 		return &originalMessage
 	}
+	deploysTotal.Inc(strs[0], strs[1], "started")
+	buildNumber := strconv.Itoa(build.Number)
 
-	uri := fmt.Sprintf("https://ci.dev.hinata.me/%s/%d", strs[0], build.Number)
+	uri := d.config.Get().BuildLink(strs[0], build.Number)
 	originalMessage.Attachments[0].Text = fmt.Sprintf(`デプロイ始めたよ！
 	デプロイ状況はここから見てね。
 	 -> %s
 	`, uri)
 	originalMessage.Attachments[0].Color = "warning"
-	originalMessage.Attachments[0].Fields = DeployAttachmentFields(strs[0], strs[1], strs[2], buildNumber)
+	originalMessage.Attachments[0].Fields = append(
+		DeployAttachmentFields(strs[0], strs[1], strs[2], buildNumber),
+		d.requesterField(message.User.ID),
+	)
 
-	go d.notice(*repo, strs[1], strs[2], buildNumber, message.Channel.ID, message.ResponseURL)
+	d.watcher.Watch(deployWatch{
+		Repo:        strs[0],
+		Env:         strs[1],
+		From:        strs[2],
+		Build:       buildNumber,
+		Channel:     message.Channel.ID,
+		ResponseURL: message.ResponseURL,
+		ThreadTs:    message.MessageTs,
+		User:        message.User.ID,
+		StartedAt:   time.Now(),
+	}, d.notice)
 
 	return &originalMessage
 }
 
-func (d *Deploy) notice(repo drone.Repo, env, from, target, channel, url string) {
+// notice watches the deploy build until it finishes or ctx is canceled.
+// The next queued deploy of the env starts when it finishes.
+func (d *Deploy) notice(ctx context.Context, dw deployWatch) {
+	defer func() {
+		// The deploy is still running if canceled by shutdown.
+		if ctx.Err() != nil {
+			return
+		}
+		// Queued deploys are left to the next process, which starts them after resuming.
+		if d.watcher.Stopping() {
+			logger.Info("Leave queued deploys to the next process", zap.String("repo", dw.Repo), zap.String("env", dw.Env))
+			return
+		}
+		d.next(dw.Repo, dw.Env)
+	}()
+
 	params := slack.PostMessageParameters{
 		Attachments: []slack.Attachment{
 			slack.Attachment{
 				Text:   "",
-				Fields: DeployAttachmentFields(repo.FullName(), env, from, target),
+				Fields: append(DeployAttachmentFields(dw.Repo, dw.Env, dw.From, dw.Build), d.requesterField(dw.User)),
 				Color:  "good",
 			},
 		},
 	}
 
-	postMessage := func(params slack.PostMessageParameters) {
-		input, err := json.Marshal(params)
-		if err != nil {
-			logger.Info("Failed to unexpected error", zap.String("detail", err.Error()))
-		}
+	num, err := strconv.Atoi(dw.Build)
+	if err != nil {
+		logger.Error("Failed to watch deploy", zap.String("detail", err.Error()))
+		return
+	}
 
-		_, err = http.Post(url, "application/json", bytes.NewBuffer(input))
-		if err != nil {
-			logger.Info("Failed to unexpected error", zap.String("detail", err.Error()))
-		}
-		if err != nil {
-			logger.Error(err.Error())
-		}
+	// Wait for webhooks and poll drone only if no webhook arrives in time.
+	events, unsubscribe := d.events.Subscribe(dw.Repo, num)
+	defer unsubscribe()
+	interval := deployPollInterval
+	if d.events.Enabled() {
+		interval = webhookTimeout
 	}
 
+	var (
+		started bool
+		// failedSince is when drone started failing. Zero while it answers.
+		failedSince time.Time
+	)
+	build, err := d.drone.ForRepo(dw.Repo).GetBuild(dw.Repo, num)
 	for {
-		num, err := strconv.Atoi(target)
-		if err != err {
-			logger.Info("Failed to unexpected error", zap.String("detail", err.Error()))
+		if err != nil && err != drone.ErrBuildNotFound {
+			if failedSince.IsZero() {
+				failedSince = time.Now()
+			}
+			if time.Since(failedSince) < deployRetryLimit {
+				logger.Warn("Failed to get deploy build", zap.String("repo", dw.Repo), zap.String("build", dw.Build), zap.String("detail", err.Error()))
+				select {
+				case ev := <-events:
+					build, err = ev.Build, nil
+				case <-time.After(deployPollInterval):
+					build, err = d.drone.ForRepo(dw.Repo).GetBuild(dw.Repo, num)
+				case <-ctx.Done():
+					logger.Warn("Stop watching deploy", zap.String("repo", dw.Repo), zap.String("build", dw.Build))
+					return
+				}
+				continue
+			}
 		}
-
-		build, err := d.drone.GetBuild(&repo, num)
 		if err != nil {
+			logger.Error("Failed to watch deploy", zap.String("repo", dw.Repo), zap.String("build", dw.Build), zap.String("detail", err.Error()))
+			deploysTotal.Inc(dw.Repo, dw.Env, "error")
+			d.deploymentStatus(dw, github.DeploymentError)
 			params.Attachments[0].Text = "デプロイに失敗したみたい..."
 			params.Attachments[0].Color = "danger"
-			postMessage(params)
-			break
+			d.postResult(dw, params)
+			return
 		}
-		if build.Status == "failure" {
-			params.Attachments[0].Text = "デプロイに失敗したみたい..."
-			params.Attachments[0].Color = "danger"
-			postMessage(params)
-			break
+		failedSince = time.Time{}
+		if !started {
+			dw = d.startDeployment(dw, build)
+			started = true
 		}
-		if build.Status == "running" {
-			time.Sleep(5)
+		// drone 1.x reports pending until a runner picks the build.
+		if build.Status == "running" || build.Status == "pending" {
+			select {
+			case ev := <-events:
+				build = ev.Build
+			case <-time.After(interval):
+				build, err = d.drone.ForRepo(dw.Repo).GetBuild(dw.Repo, num)
+			case <-ctx.Done():
+				logger.Warn("Stop watching deploy", zap.String("repo", dw.Repo), zap.String("build", dw.Build))
+				return
+			}
 			continue
 		}
-		if build.Status == "success" {
-			postMessage(params)
-			d.slack.PostMessage(channel, "", slack.PostMessageParameters{
-				Attachments: []slack.Attachment{
-					slack.Attachment{
-						Text:  "<!here> デプロイ終わったよー",
-						Color: "good",
-					},
+
+		observeDeploy(dw.Repo, dw.Env, build)
+		if build.Status != "success" {
+			// failure, killed, error and so on
+			d.deploymentStatus(dw, github.DeploymentFailure)
+			params.Attachments[0].Text = fmt.Sprintf("デプロイに失敗したみたい... (%s)", build.Status)
+			params.Attachments[0].Color = "danger"
+			d.postResult(dw, params)
+			return
+		}
+		d.deploymentStatus(dw, github.DeploymentSuccess)
+		d.postResult(dw, params)
+		if dw.Channel == "" {
+			return
+		}
+		d.slack.PostMessage(dw.Channel, "", slack.PostMessageParameters{
+			Attachments: []slack.Attachment{
+				slack.Attachment{
+					Text:  "<!here> デプロイ終わったよー",
+					Color: "good",
 				},
-			})
-			break
+			},
+			ThreadTimestamp: dw.ThreadTs,
+		})
+		return
+	}
+}
+
+// postResult replaces the interactive message by the response URL.
+// It posts to the thread instead if the response URL is not available or expired.
+func (d *Deploy) postResult(dw deployWatch, params slack.PostMessageParameters) {
+	if dw.ResponseURL != "" {
+		err := postResponse(dw.ResponseURL, params)
+		if err == nil {
+			return
 		}
+		slackErrorsTotal.Inc("response_url")
+		logger.Warn("Failed to post to response url", zap.String("detail", err.Error()))
+	}
+
+	// Scheduled deploys without the report channel are not posted.
+	if dw.Channel == "" {
+		return
+	}
+	params.ThreadTimestamp = dw.ThreadTs
+	if _, _, err := d.slack.PostMessage(dw.Channel, "", params); err != nil {
+		logger.Error("Failed to post message", zap.String("detail", err.Error()))
+	}
+}
+
+// responseClient posts to response URLs. The timeout bounds the wait of answers to the confirmation
+// while the changelog is being posted.
+var responseClient = &http.Client{Timeout: 5 * time.Second}
+
+// postResponse posts the message to the response URL of the interactive message.
+func postResponse(responseURL string, message interface{}) error {
+	input, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	res, err := responseClient.Post(responseURL, "application/json", bytes.NewBuffer(input))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("response url returned %d", res.StatusCode)
 	}
+	return nil
 }
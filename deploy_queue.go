@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vivitInc/maguro/statestore"
+)
+
+// queuedDeployPrefix distinguishes IDs of queued deploys from scheduled ones.
+const queuedDeployPrefix = "q"
+
+// QueuedDeploy is a deploy waiting for the running deploy of the same repository and env.
+type QueuedDeploy struct {
+	ID     string `json:"id"`
+	Repo   string `json:"repo"`
+	Env    string `json:"env"`
+	Number int    `json:"number"`
+	// User is the Slack user ID who requested the deploy.
+	User     string    `json:"user"`
+	Channel  string    `json:"channel"`
+	QueuedAt time.Time `json:"queued_at"`
+}
+
+// InflightDeploy is a deploy running now.
+type InflightDeploy struct {
+	Repo string
+	Env  string
+	// From is the build number deployed.
+	From      string
+	User      string
+	StartedAt time.Time
+}
+
+func deployKey(repo, env string) string {
+	return repo + ":" + env
+}
+
+// DeployQueue allows only one deploy per repository and env at a time.
+// Deploys requested while another one is running are queued in the state store
+// and started in order when the running one finishes.
+type DeployQueue struct {
+	mu       sync.Mutex
+	state    statestore.Store
+	nextID   int
+	inflight map[string]InflightDeploy
+	queued   []QueuedDeploy
+}
+
+// NewDeployQueue restores queued deploys from st. Queued deploys are not saved if st is nil.
+// running are deploy watches resumed after restart.
+func NewDeployQueue(st statestore.Store, running []deployWatch) (*DeployQueue, error) {
+	q := &DeployQueue{state: st}
+	if err := q.Load(running); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Load restores queued deploys saved by the last leader.
+// running are deploy watches taken over from it.
+func (q *DeployQueue) Load(running []deployWatch) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	inflight := map[string]InflightDeploy{}
+	for _, dw := range running {
+		inflight[deployKey(dw.Repo, dw.Env)] = InflightDeploy{Repo: dw.Repo, Env: dw.Env, From: dw.From, User: dw.User, StartedAt: dw.StartedAt}
+	}
+	queued := []QueuedDeploy{}
+	if q.state != nil {
+		buf, err := q.state.Read(queueState)
+		if err != nil {
+			return err
+		}
+		if buf != nil {
+			if err := json.Unmarshal(buf, &queued); err != nil {
+				return fmt.Errorf("%s: %s", queueState, err)
+			}
+		}
+	}
+
+	q.nextID, q.inflight, q.queued = 1, inflight, queued
+	for _, qd := range q.queued {
+		if id, err := strconv.Atoi(strings.TrimPrefix(qd.ID, queuedDeployPrefix)); err == nil && id >= q.nextID {
+			q.nextID = id + 1
+		}
+	}
+	return nil
+}
+
+// Acquire marks the deploy running and returns true if no deploy of the repository and env is running.
+// Otherwise the deploy is queued and returned with ID.
+func (q *DeployQueue) Acquire(qd QueuedDeploy) (QueuedDeploy, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	key := deployKey(qd.Repo, qd.Env)
+	if _, ok := q.inflight[key]; !ok {
+		q.start(qd)
+		return qd, true, nil
+	}
+
+	qd.ID = queuedDeployPrefix + strconv.Itoa(q.nextID)
+	q.nextID++
+	qd.QueuedAt = time.Now()
+	q.queued = append(q.queued, qd)
+	if err := q.save(); err != nil {
+		q.queued = q.queued[:len(q.queued)-1]
+		return qd, false, err
+	}
+	return qd, false, nil
+}
+
+// Release marks the deploy of the repository and env finished.
+// The next queued deploy is returned and marked running if any.
+func (q *DeployQueue) Release(repo, env string) (QueuedDeploy, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.inflight, deployKey(repo, env))
+	for i, qd := range q.queued {
+		if qd.Repo != repo || qd.Env != env {
+			continue
+		}
+		q.queued = append(q.queued[:i], q.queued[i+1:]...)
+		q.start(qd)
+		return qd, true, q.save()
+	}
+	return QueuedDeploy{}, false, nil
+}
+
+// Ready returns queued deploys which are first in line but nothing is running for,
+// e.g. the running deploy was lost by restart. They are marked running.
+func (q *DeployQueue) Ready() ([]QueuedDeploy, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	list := []QueuedDeploy{}
+	rest := []QueuedDeploy{}
+	for _, qd := range q.queued {
+		if _, ok := q.inflight[deployKey(qd.Repo, qd.Env)]; ok {
+			rest = append(rest, qd)
+			continue
+		}
+		q.start(qd)
+		list = append(list, qd)
+	}
+	if len(list) == 0 {
+		return list, nil
+	}
+	q.queued = rest
+	return list, q.save()
+}
+
+// Cancel removes the queued deploy.
+func (q *DeployQueue) Cancel(id string) (QueuedDeploy, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, qd := range q.queued {
+		if qd.ID != id {
+			continue
+		}
+		q.queued = append(q.queued[:i], q.queued[i+1:]...)
+		return qd, q.save()
+	}
+	return QueuedDeploy{}, fmt.Errorf("queued deploy %s not found", id)
+}
+
+// Running returns the deploy running for the repository and env.
+func (q *DeployQueue) Running(repo, env string) (InflightDeploy, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	d, ok := q.inflight[deployKey(repo, env)]
+	return d, ok
+}
+
+// List returns running deploys sorted by repository and env, and queued deploys in order.
+func (q *DeployQueue) List() ([]InflightDeploy, []QueuedDeploy) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	running := []InflightDeploy{}
+	for _, d := range q.inflight {
+		running = append(running, d)
+	}
+	sort.Slice(running, func(i, j int) bool {
+		return deployKey(running[i].Repo, running[i].Env) < deployKey(running[j].Repo, running[j].Env)
+	})
+	return running, append([]QueuedDeploy{}, q.queued...)
+}
+
+// Position returns how many deploys are waiting ahead of the queued deploy, including itself.
+func (q *DeployQueue) Position(qd QueuedDeploy) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, d := range q.queued {
+		if d.Repo == qd.Repo && d.Env == qd.Env {
+			n++
+		}
+		if d.ID == qd.ID {
+			break
+		}
+	}
+	return n
+}
+
+// start marks the deploy running. q.mu must be held.
+func (q *DeployQueue) start(qd QueuedDeploy) {
+	q.inflight[deployKey(qd.Repo, qd.Env)] = InflightDeploy{
+		Repo:      qd.Repo,
+		Env:       qd.Env,
+		From:      strconv.Itoa(qd.Number),
+		User:      qd.User,
+		StartedAt: time.Now(),
+	}
+}
+
+// save writes queued deploys. q.mu must be held.
+func (q *DeployQueue) save() error {
+	if q.state == nil {
+		return nil
+	}
+	buf, err := json.MarshalIndent(q.queued, "", "  ")
+	if err != nil {
+		return err
+	}
+	return q.state.Write(queueState, buf)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/vivitInc/maguro/drone"
+	"github.com/vivitInc/maguro/github"
+	"go.uber.org/zap"
+)
+
+// deployments returns the client of GitHub Deployments.
+// nil if GitHub or its token is not configured.
+func (d *Deploy) deployments() *github.Client {
+	gh := d.config.Get().GitHub
+	if gh == nil || gh.Token == "" {
+		return nil
+	}
+	return github.NewClient(gh.APIURL, gh.Token)
+}
+
+// startDeployment creates GitHub Deployment of the deploy build and marks it in progress.
+// The deployment ID is saved to the watch so that its status is updated after restart.
+func (d *Deploy) startDeployment(dw deployWatch, build *drone.Build) deployWatch {
+	client := d.deployments()
+	if client == nil || dw.Deployment != 0 || build.Sha == "" {
+		return dw
+	}
+
+	id, err := client.CreateDeployment(dw.Repo, github.Deployment{
+		Ref:         build.Sha,
+		Environment: dw.Env,
+		Description: d.deploymentDescription(dw),
+		Payload:     map[string]string{"build": dw.From, "deploy_build": dw.Build},
+	})
+	if err != nil {
+		githubErrorsTotal.Inc("CreateDeployment")
+		logger.Warn("Failed to create deployment", zap.String("repo", dw.Repo), zap.String("detail", err.Error()))
+		return dw
+	}
+	dw.Deployment = id
+	d.watcher.Update(dw)
+	d.deploymentStatus(dw, github.DeploymentInProgress)
+	return dw
+}
+
+// deploymentStatus updates the state of GitHub Deployment of the deploy if it was created.
+func (d *Deploy) deploymentStatus(dw deployWatch, state string) {
+	client := d.deployments()
+	if client == nil || dw.Deployment == 0 {
+		return
+	}
+
+	number, _ := strconv.Atoi(dw.Build)
+	err := client.CreateDeploymentStatus(dw.Repo, dw.Deployment, github.DeploymentStatus{
+		State:       state,
+		LogURL:      d.config.Get().BuildLink(dw.Repo, number),
+		Description: d.deploymentDescription(dw),
+	})
+	if err != nil {
+		githubErrorsTotal.Inc("CreateDeploymentStatus")
+		logger.Warn("Failed to update deployment status", zap.String("repo", dw.Repo), zap.String("state", state), zap.String("detail", err.Error()))
+	}
+}
+
+// deploymentDescription shows the build and who deployed it on GitHub.
+func (d *Deploy) deploymentDescription(dw deployWatch) string {
+	desc := fmt.Sprintf("maguro: #%s", dw.From)
+	if u, ok := d.users.FindBySlack(dw.User); ok {
+		name := u.Login
+		if name == "" {
+			name = u.Name
+		}
+		if name != "" {
+			desc += " by " + name
+		}
+	}
+	return desc
+}
@@ -1,8 +1,50 @@
 package drone
 
+import "time"
+
 type Build struct {
-	Number  int
+	Number int
+	// Commit is the short commit SHA and Sha is the full one.
 	Commit  string
+	Sha     string
 	Message string
 	Status  string
+	Event   string
+	Branch  string
+	Author  string
+	Email   string
+	Link    string
+	Deploy  string
+	// Parent is the build number restarted or promoted by this build. 0 if none.
+	Parent   int
+	Started  int64
+	Finished int64
+	// Stages are available only on drone 1.x or later.
+	Stages []Stage
+}
+
+type Stage struct {
+	Number int
+	Name   string
+	Status string
+	Steps  []Step
+}
+
+type Step struct {
+	Number int
+	Name   string
+	Status string
+}
+
+// Duration returns elapsed time of the build.
+// Running build is measured until now.
+func (b *Build) Duration() time.Duration {
+	if b.Started == 0 {
+		return 0
+	}
+	finished := b.Finished
+	if finished == 0 {
+		finished = time.Now().Unix()
+	}
+	return time.Duration(finished-b.Started) * time.Second
 }
@@ -0,0 +1,85 @@
+package drone
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// VersionLegacy is drone 0.8 API.
+	VersionLegacy = "0.8"
+	// VersionV1 is drone 1.x and 2.x API.
+	VersionV1 = "1"
+)
+
+// ErrNotSupported is returned when drone server doesn't support the operation.
+var ErrNotSupported = errors.New("not supported by this drone version")
+
+// Client is the set of drone operations maguro uses.
+// *Drone implements it.
+type Client interface {
+	Ping() error
+	GetRepositories(owners []string) ([]Repo, error)
+	GetBuilds(fullName string) ([]*Build, error)
+	GetRunningBuildNumber(fullName string) ([]*Build, error)
+	GetSucceededBuilds(fullName string) ([]*Build, error)
+	GetLatestBuilds(fullName string) ([]*Build, error)
+	GetLatestBuild(fullName, branch string, statuses, events []string) (*Build, error)
+	GetBuild(fullName string, number int) (*Build, error)
+	GetBuildLogs(fullName string, number, stage, step int) ([]string, error)
+	CreateBuild(fullName, branch string, params map[string]string) (*Build, error)
+	StartBuild(fullName string, number int) (*Build, error)
+	RestartBuild(fullName string, number int) error
+	KillBuild(fullName string, number int) error
+	Deploy(fullName string, number int, env string, params map[string]string) (*Build, error)
+	GetCrons(fullName string) ([]*Cron, error)
+	ExecCron(fullName, cron string) error
+}
+
+var _ Client = (*Drone)(nil)
+
+// versionClient is API client of a specific drone version.
+type versionClient interface {
+	RepoList() ([]Repo, error)
+	BuildList(owner, name string) ([]*Build, error)
+	Build(owner, name string, number int) (*Build, error)
+	BuildCreate(owner, name, branch string, params map[string]string) (*Build, error)
+	BuildRestart(owner, name string, number int, params map[string]string) (*Build, error)
+	BuildCancel(owner, name string, number int) error
+	BuildLogs(owner, name string, number, stage, step int) ([]string, error)
+	Promote(owner, name string, number int, target string, params map[string]string) (*Build, error)
+	CronList(owner, name string) ([]*Cron, error)
+	CronExec(owner, name, cron string) error
+}
+
+// Cron is a cron job registered in drone.
+type Cron struct {
+	Name   string
+	Expr   string
+	Branch string
+	Next   int64
+}
+
+// parseVersion returns VersionLegacy or VersionV1 from a version string.
+// e.g. 0.8.6, 1.10.1, 2.16.0
+func parseVersion(version string) (string, error) {
+	v := strings.TrimPrefix(strings.TrimSpace(version), "v")
+	switch {
+	case v == "":
+		return "", errors.New("empty drone version")
+	case strings.HasPrefix(v, "0."):
+		return VersionLegacy, nil
+	case v == VersionV1, strings.HasPrefix(v, "1."), strings.HasPrefix(v, "2."):
+		return VersionV1, nil
+	}
+	return "", fmt.Errorf("unsupported drone version %s", version)
+}
+
+func shortCommit(commit string) string {
+	r := []rune(commit)
+	if len(r) > 6 {
+		return string(r[:6])
+	}
+	return commit
+}
@@ -1,18 +1,32 @@
 package drone
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/drone/drone-go/drone"
 	"golang.org/x/oauth2"
 )
 
+// ErrBuildNotFound is returned when no build matches.
+var ErrBuildNotFound = errors.New("build not found")
+
 type Drone struct {
-	client drone.Client
-	owner  string
+	host    string
+	version string
+	auther  *http.Client
+
+	mu     sync.Mutex
+	client versionClient
 }
 
-func NewDrone(host, token, owner string) *Drone {
+// NewDrone returns drone client.
+// version is VersionLegacy or VersionV1. The version is detected from the server if empty.
+func NewDrone(host, token, version string) *Drone {
 	config := new(oauth2.Config)
 	auther := config.Client(
 		oauth2.NoContext,
@@ -20,24 +34,110 @@ func NewDrone(host, token, owner string) *Drone {
 			AccessToken: token,
 		},
 	)
-	client := drone.NewClient(host, auther)
-	return &Drone{client, owner}
+	return &Drone{host: host, version: version, auther: auther}
+}
+
+// repoAPI returns the API client and the repository of fullName.
+func (d *Drone) repoAPI(fullName string) (versionClient, *Repo, error) {
+	repo, err := GetRepoFromFullName(fullName)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := d.api()
+	return c, repo, err
+}
+
+// api returns API client for the server version.
+// Detection is retried on next call if it failed.
+func (d *Drone) api() (versionClient, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.client != nil {
+		return d.client, nil
+	}
+
+	version := d.version
+	if version == "" {
+		v, err := detectVersion(d.host, d.auther)
+		if err != nil {
+			return nil, fmt.Errorf("failed to detect drone version: %s", err)
+		}
+		version = v
+	}
+	switch version {
+	case VersionLegacy:
+		d.client = newLegacyClient(d.host, d.auther)
+	case VersionV1:
+		d.client = newV1Client(d.host, d.auther)
+	default:
+		return nil, fmt.Errorf("unsupported drone version %s", version)
+	}
+	return d.client, nil
+}
+
+// pingTimeout is the timeout of Ping.
+const pingTimeout = 10 * time.Second
+
+// Ping checks the server is reachable and the token is valid by the current user API.
+// The API is the same on drone 0.8 and 1.x.
+func (d *Drone) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(d.host, "/")+"/api/user", nil)
+	if err != nil {
+		return err
+	}
+	res, err := d.auther.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("drone: GET /api/user: %d", res.StatusCode)
+	}
+	return nil
 }
 
-func (d *Drone) GetRepositories() ([]Repo, error) {
-	repos, err := d.client.RepoList()
+// GetRepositories returns repositories owned by owners.
+// All repositories are returned if owners is empty.
+func (d *Drone) GetRepositories(owners []string) ([]Repo, error) {
+	c, err := d.api()
+	if err != nil {
+		return []Repo{}, err
+	}
+	repos, err := c.RepoList()
 	if err != nil {
 		return []Repo{}, err
 	}
+	allowed := map[string]bool{}
+	for _, o := range owners {
+		allowed[o] = true
+	}
 	list := []Repo{}
 	for _, r := range repos {
-		list = append(list, Repo{r.Owner, r.Name})
+		if len(allowed) != 0 && !allowed[r.Owner] {
+			continue
+		}
+		list = append(list, r)
 	}
 	return list, nil
 }
 
-func (d *Drone) GetRunningBuildNumber(repo *Repo) ([]*Build, error) {
-	builds, err := d.client.BuildList(repo.Owner, repo.Name)
+func (d *Drone) buildList(fullName string) ([]*Build, error) {
+	c, repo, err := d.repoAPI(fullName)
+	if err != nil {
+		return nil, err
+	}
+	return c.BuildList(repo.Owner, repo.Name)
+}
+
+// GetBuilds returns recent builds sorted by newest first.
+func (d *Drone) GetBuilds(fullName string) ([]*Build, error) {
+	return d.buildList(fullName)
+}
+
+func (d *Drone) GetRunningBuildNumber(fullName string) ([]*Build, error) {
+	builds, err := d.buildList(fullName)
 	if err != nil {
 		return nil, err
 	}
@@ -45,33 +145,35 @@ func (d *Drone) GetRunningBuildNumber(repo *Repo) ([]*Build, error) {
 	numbers := []*Build{}
 	for _, b := range builds {
 		if b.Status == "running" {
-			numbers = append(numbers, &Build{
-				b.Number,
-				string([]rune(b.Commit)[:6]),
-				b.Message,
-				b.Status,
-			})
+			numbers = append(numbers, b)
 		}
 	}
 
 	return numbers, nil
 }
 
-func (d *Drone) RestartBuild(repo Repo, number int) error {
-	err := d.client.BuildKill(repo.Owner, repo.Name, number)
+func (d *Drone) RestartBuild(fullName string, number int) error {
+	c, repo, err := d.repoAPI(fullName)
 	if err != nil {
 		return err
 	}
-	_, res := d.client.BuildStart(repo.Owner, repo.Name, number, nil)
-	return res
+	if err := c.BuildCancel(repo.Owner, repo.Name, number); err != nil {
+		return err
+	}
+	_, err = c.BuildRestart(repo.Owner, repo.Name, number, nil)
+	return err
 }
 
-func (d *Drone) KillBuild(repo Repo, number int) error {
-	return d.client.BuildKill(repo.Owner, repo.Name, number)
+func (d *Drone) KillBuild(fullName string, number int) error {
+	c, repo, err := d.repoAPI(fullName)
+	if err != nil {
+		return err
+	}
+	return c.BuildCancel(repo.Owner, repo.Name, number)
 }
 
-func (d *Drone) GetSucceededBuilds(repo *Repo) ([]*Build, error) {
-	list, err := d.client.BuildList(repo.Owner, repo.Name)
+func (d *Drone) GetSucceededBuilds(fullName string) ([]*Build, error) {
+	list, err := d.buildList(fullName)
 	if err != nil {
 		return nil, err
 	}
@@ -79,55 +181,124 @@ func (d *Drone) GetSucceededBuilds(repo *Repo) ([]*Build, error) {
 	builds := []*Build{}
 	for _, b := range list {
 		if b.Status == "success" {
-			builds = append(builds, &Build{
-				b.Number,
-				string([]rune(b.Commit)[:6]),
-				b.Message,
-				b.Status,
-			})
+			builds = append(builds, b)
+		}
+	}
+	return builds, nil
+}
+
+func (d *Drone) GetBuild(fullName string, number int) (*Build, error) {
+	c, repo, err := d.repoAPI(fullName)
+	if err != nil {
+		return nil, err
+	}
+	return c.Build(repo.Owner, repo.Name, number)
+}
+
+// GetLatestBuilds returns the latest build of each branch.
+// Deployments and pull requests are ignored.
+func (d *Drone) GetLatestBuilds(fullName string) ([]*Build, error) {
+	list, err := d.buildList(fullName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Build list is sorted by newest first.
+	seen := map[string]bool{}
+	builds := []*Build{}
+	for _, b := range list {
+		if b.Deploy != "" || b.Event == "pull_request" || seen[b.Branch] {
+			continue
 		}
+		seen[b.Branch] = true
+		builds = append(builds, b)
 	}
 	return builds, nil
 }
 
-func (d *Drone) GetBuild(repo *Repo, number int) (*Build, error) {
-	b, err := d.client.Build(repo.Owner, repo.Name, number)
+// GetBuildLogs returns log lines of the step.
+// stage is the job number and step is ignored on drone 0.8.
+func (d *Drone) GetBuildLogs(fullName string, number, stage, step int) ([]string, error) {
+	c, repo, err := d.repoAPI(fullName)
+	if err != nil {
+		return nil, err
+	}
+	return c.BuildLogs(repo.Owner, repo.Name, number, stage, step)
+}
+
+// CreateBuild starts a new build of the branch head.
+func (d *Drone) CreateBuild(fullName, branch string, params map[string]string) (*Build, error) {
+	c, repo, err := d.repoAPI(fullName)
 	if err != nil {
 		return nil, err
 	}
-	return &Build{
-		b.Number,
-		string([]rune(b.Commit)[:6]),
-		b.Message,
-		b.Status,
-	}, nil
+	return c.BuildCreate(repo.Owner, repo.Name, branch, params)
 }
 
-func (d *Drone) Deploy(repo Repo, number int, env string, params map[string]string) (*drone.Build, error) {
-	build, err := d.client.Deploy(repo.Owner, repo.Name, number, env, params)
-	return build, err
+// Deploy promotes the build to env.
+func (d *Drone) Deploy(fullName string, number int, env string, params map[string]string) (*Build, error) {
+	c, repo, err := d.repoAPI(fullName)
+	if err != nil {
+		return nil, err
+	}
+	return c.Promote(repo.Owner, repo.Name, number, env, params)
 }
 
-func (d *Drone) RestartSucceededMasterBuild(repo Repo) {
-	list, err := d.client.BuildList(repo.Owner, repo.Name)
+func (d *Drone) GetCrons(fullName string) ([]*Cron, error) {
+	c, repo, err := d.repoAPI(fullName)
 	if err != nil {
-		fmt.Printf("%s", err)
+		return nil, err
 	}
+	return c.CronList(repo.Owner, repo.Name)
+}
 
-	var build *drone.Build
+func (d *Drone) ExecCron(fullName, cron string) error {
+	c, repo, err := d.repoAPI(fullName)
+	if err != nil {
+		return err
+	}
+	return c.CronExec(repo.Owner, repo.Name, cron)
+}
+
+// GetLatestBuild returns the newest build on the branch whose status is in statuses
+// and event is in events. Any event matches if events is empty.
+// Deployments and pull requests are ignored. Branches of pull requests from forks may have the same name
+// and drone 0.8 reports the base branch as the branch of pull requests.
+func (d *Drone) GetLatestBuild(fullName, branch string, statuses, events []string) (*Build, error) {
+	list, err := d.buildList(fullName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Build list is sorted by newest first.
 	for _, b := range list {
-		if b.Branch != "master" {
+		if b.Branch != branch || b.Deploy != "" || b.Event == "pull_request" {
 			continue
 		}
-		if b.Status != "success" {
+		if len(events) != 0 && !contains(events, b.Event) {
 			continue
 		}
-		build = b
+		if contains(statuses, b.Status) {
+			return b, nil
+		}
 	}
+	return nil, ErrBuildNotFound
+}
 
-	if build == nil {
-		return
+// StartBuild restarts a finished build and returns the new build.
+func (d *Drone) StartBuild(fullName string, number int) (*Build, error) {
+	c, repo, err := d.repoAPI(fullName)
+	if err != nil {
+		return nil, err
 	}
+	return c.BuildRestart(repo.Owner, repo.Name, number, nil)
+}
 
-	_, err = d.client.BuildStart(repo.Owner, repo.Name, build.Number, nil)
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
 }
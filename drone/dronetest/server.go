@@ -0,0 +1,367 @@
+// Package dronetest provides an in-process fake drone server speaking drone 1.x API.
+//
+//	srv := dronetest.NewServer()
+//	defer srv.Close()
+//	srv.AddBuild("owner/repo", dronetest.Build{Branch: "master", Status: "success"})
+//	srv.Script("owner/repo", "pending", "running", "success")
+//	client := srv.Client()
+package dronetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vivitInc/maguro/drone"
+)
+
+// Build is a build held by the fake server.
+type Build struct {
+	Number  int
+	Status  string
+	Event   string
+	Branch  string
+	Commit  string
+	Message string
+	Author  string
+	Email   string
+	Deploy  string
+	// Parent is set to the original build by restart and promote.
+	Parent int
+	Params map[string]string
+	Logs   []string
+
+	started  int64
+	finished int64
+	// statuses to go through on each read
+	script []string
+}
+
+type repo struct {
+	builds []*Build
+	crons  []string
+}
+
+// Server is a fake drone server.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	repos    map[string]*repo
+	scripts  map[string][]string
+	requests []string
+}
+
+func NewServer() *Server {
+	s := &Server{
+		repos:   map[string]*repo{},
+		scripts: map[string][]string{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Client returns a drone client connected to the server.
+func (s *Server) Client() *drone.Drone {
+	return drone.NewDrone(s.URL, "dronetest", drone.VersionV1)
+}
+
+// AddRepo registers the repository. format: {owner}/{name}
+func (s *Server) AddRepo(fullName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.repo(fullName)
+}
+
+// AddBuild adds the build to the repository and returns its number.
+func (s *Server) AddBuild(fullName string, b Build) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.add(s.repo(fullName), &b).Number
+}
+
+// AddCron registers the cron job to the repository.
+func (s *Server) AddCron(fullName, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.repo(fullName)
+	r.crons = append(r.crons, name)
+}
+
+// Script sets statuses which builds created afterwards go through.
+// Each read of the build advances it to the next status and the last one stays.
+func (s *Server) Script(fullName string, statuses ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts[fullName] = statuses
+}
+
+// Build returns the current state of the build.
+func (s *Server) Build(fullName string, number int) (Build, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.find(s.repo(fullName), number)
+	if b == nil {
+		return Build{}, false
+	}
+	return *b, true
+}
+
+// Requests returns received requests. format: {method} {path}
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+func (s *Server) repo(fullName string) *repo {
+	r, ok := s.repos[fullName]
+	if !ok {
+		r = &repo{}
+		s.repos[fullName] = r
+	}
+	return r
+}
+
+func (s *Server) add(r *repo, b *Build) *Build {
+	b.Number = len(r.builds) + 1
+	if b.Status == "" {
+		b.Status = "success"
+	}
+	if b.Event == "" {
+		b.Event = "push"
+	}
+	if b.started == 0 {
+		b.started = time.Now().Unix()
+	}
+	r.builds = append(r.builds, b)
+	return b
+}
+
+func (s *Server) start(fullName string, b *Build) *Build {
+	script := s.scripts[fullName]
+	if len(script) != 0 {
+		b.Status = script[0]
+		b.script = script[1:]
+	}
+	return s.add(s.repo(fullName), b)
+}
+
+func (s *Server) find(r *repo, number int) *Build {
+	if number < 1 || number > len(r.builds) {
+		return nil
+	}
+	return r.builds[number-1]
+}
+
+// advance moves the build to the next scripted status.
+func advance(b *Build) {
+	if len(b.script) == 0 {
+		return
+	}
+	b.Status = b.script[0]
+	b.script = b.script[1:]
+	if len(b.script) == 0 && b.Status != "running" && b.Status != "pending" {
+		b.finished = time.Now().Unix()
+	}
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+
+	if r.URL.Path == "/version" {
+		writeJSON(w, map[string]string{"version": "1.10.1"})
+		return
+	}
+	if r.URL.Path == "/api/user" {
+		writeJSON(w, map[string]string{"login": "dronetest"})
+		return
+	}
+	if r.URL.Path == "/api/user/repos" {
+		names := []string{}
+		for name := range s.repos {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		repos := []map[string]string{}
+		for _, name := range names {
+			strs := strings.SplitN(name, "/", 2)
+			repos = append(repos, map[string]string{"namespace": strs[0], "name": strs[1], "slug": name})
+		}
+		writeJSON(w, repos)
+		return
+	}
+
+	// /api/repos/{owner}/{name}/...
+	p := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(p) < 5 || p[0] != "api" || p[1] != "repos" {
+		http.NotFound(w, r)
+		return
+	}
+	fullName := p[2] + "/" + p[3]
+	repo, ok := s.repos[fullName]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch p[4] {
+	case "builds":
+		s.serveBuilds(w, r, fullName, repo, p[5:])
+	case "cron":
+		s.serveCron(w, r, repo, p[5:])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveBuilds(w http.ResponseWriter, r *http.Request, fullName string, repo *repo, p []string) {
+	query := r.URL.Query()
+	if len(p) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			// newest first as drone does
+			list := []map[string]interface{}{}
+			for i := len(repo.builds) - 1; i >= 0; i-- {
+				list = append(list, buildJSON(repo.builds[i]))
+			}
+			writeJSON(w, list)
+		case http.MethodPost:
+			b := s.start(fullName, &Build{
+				Branch: query.Get("branch"),
+				Commit: fmt.Sprintf("%040d", len(repo.builds)+1),
+				Event:  "custom",
+				Params: queryToMap(query, "branch"),
+			})
+			writeJSON(w, buildJSON(b))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	number, err := strconv.Atoi(p[0])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	b := s.find(repo, number)
+	if b == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case len(p) == 1 && r.Method == http.MethodGet:
+		advance(b)
+		writeJSON(w, buildJSON(b))
+	case len(p) == 1 && r.Method == http.MethodPost:
+		restarted := *b
+		restarted.started, restarted.finished = 0, 0
+		restarted.script = nil
+		restarted.Parent = b.Number
+		restarted.Params = queryToMap(query)
+		writeJSON(w, buildJSON(s.start(fullName, &restarted)))
+	case len(p) == 1 && r.Method == http.MethodDelete:
+		// drone leaves finished builds alone.
+		if b.Status == "pending" || b.Status == "running" {
+			b.Status = "killed"
+			b.script = nil
+			b.finished = time.Now().Unix()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(p) == 2 && p[1] == "promote" && r.Method == http.MethodPost:
+		promoted := *b
+		promoted.started, promoted.finished = 0, 0
+		promoted.script = nil
+		promoted.Event = "promote"
+		promoted.Deploy = query.Get("target")
+		promoted.Parent = b.Number
+		promoted.Params = queryToMap(query, "target")
+		writeJSON(w, buildJSON(s.start(fullName, &promoted)))
+	case len(p) == 4 && p[1] == "logs" && r.Method == http.MethodGet:
+		lines := []map[string]interface{}{}
+		for i, l := range b.Logs {
+			lines = append(lines, map[string]interface{}{"pos": i, "out": l})
+		}
+		writeJSON(w, lines)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveCron(w http.ResponseWriter, r *http.Request, repo *repo, p []string) {
+	if len(p) == 0 && r.Method == http.MethodGet {
+		list := []map[string]interface{}{}
+		for _, c := range repo.crons {
+			list = append(list, map[string]interface{}{"name": c, "expr": "@daily", "branch": "master"})
+		}
+		writeJSON(w, list)
+		return
+	}
+	if len(p) == 1 && r.Method == http.MethodPost {
+		for _, c := range repo.crons {
+			if c == p[0] {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func buildJSON(b *Build) map[string]interface{} {
+	return map[string]interface{}{
+		"number":       b.Number,
+		"status":       b.Status,
+		"event":        b.Event,
+		"message":      b.Message,
+		"after":        b.Commit,
+		"source":       b.Branch,
+		"target":       b.Branch,
+		"author_login": b.Author,
+		"author_email": b.Email,
+		"deploy_to":    b.Deploy,
+		"parent":       b.Parent,
+		"started":      b.started,
+		"finished":     b.finished,
+		"stages": []map[string]interface{}{
+			{
+				"number": 1,
+				"name":   "default",
+				"status": b.Status,
+				"steps": []map[string]interface{}{
+					{"number": 1, "name": "build", "status": b.Status},
+				},
+			},
+		},
+	}
+}
+
+func queryToMap(query map[string][]string, ignore ...string) map[string]string {
+	params := map[string]string{}
+	for k, v := range query {
+		if len(v) == 0 {
+			continue
+		}
+		params[k] = v[0]
+	}
+	for _, k := range ignore {
+		delete(params, k)
+	}
+	return params
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(v)
+}
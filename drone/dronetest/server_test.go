@@ -0,0 +1,121 @@
+package dronetest
+
+import (
+	"testing"
+
+	"github.com/vivitInc/maguro/drone"
+)
+
+// watch reads the build until it finishes as deploy watchers do, and returns the statuses seen.
+func watch(t *testing.T, client *drone.Drone, fullName string, number int) []string {
+	statuses := []string{}
+	for i := 0; i < 10; i++ {
+		b, err := client.GetBuild(fullName, number)
+		if err != nil {
+			t.Fatalf("GetBuild: %s", err)
+		}
+		statuses = append(statuses, b.Status)
+		if b.Status != "pending" && b.Status != "running" {
+			return statuses
+		}
+	}
+	t.Fatalf("build #%d didn't finish: %v", number, statuses)
+	return nil
+}
+
+func TestDeploy(t *testing.T) {
+	tests := []struct {
+		script []string
+		want   []string
+	}{
+		{[]string{"pending", "running", "success"}, []string{"running", "success"}},
+		{[]string{"pending", "running", "running", "failure"}, []string{"running", "running", "failure"}},
+	}
+	for _, tt := range tests {
+		srv := NewServer()
+		number := srv.AddBuild("owner/repo", Build{Branch: "master", Commit: "abc"})
+		srv.Script("owner/repo", tt.script...)
+		client := srv.Client()
+
+		b, err := client.Deploy("owner/repo", number, "production", map[string]string{"FOO": "bar"})
+		if err != nil {
+			t.Fatalf("Deploy: %s", err)
+		}
+		if b.Status != "pending" || b.Event != "promote" || b.Deploy != "production" || b.Parent != number {
+			t.Errorf("deploy build = %+v", b)
+		}
+		got := watch(t, client, "owner/repo", b.Number)
+		if len(got) != len(tt.want) {
+			t.Fatalf("statuses = %v, want %v", got, tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("statuses = %v, want %v", got, tt.want)
+				break
+			}
+		}
+
+		finished, _ := srv.Build("owner/repo", b.Number)
+		if finished.finished == 0 {
+			t.Errorf("finished time of %s build is not set", finished.Status)
+		}
+		if finished.Params["FOO"] != "bar" {
+			t.Errorf("params = %v", finished.Params)
+		}
+		srv.Close()
+	}
+}
+
+func TestRestartBuild(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	number := srv.AddBuild("owner/repo", Build{Branch: "master", Status: "failure"})
+	srv.Script("owner/repo", "running", "success")
+	client := srv.Client()
+
+	b, err := client.StartBuild("owner/repo", number)
+	if err != nil {
+		t.Fatalf("StartBuild: %s", err)
+	}
+	if b.Number != number+1 || b.Parent != number || b.Branch != "master" {
+		t.Errorf("restarted build = %+v", b)
+	}
+	if got := watch(t, client, "owner/repo", b.Number); got[len(got)-1] != "success" {
+		t.Errorf("statuses = %v", got)
+	}
+
+	// RestartBuild cancels the build before restarting it, which doesn't change the finished build.
+	if err := client.RestartBuild("owner/repo", b.Number); err != nil {
+		t.Fatalf("RestartBuild: %s", err)
+	}
+	if finished, _ := srv.Build("owner/repo", b.Number); finished.Status != "success" {
+		t.Errorf("status of finished build = %s", finished.Status)
+	}
+	restarted, ok := srv.Build("owner/repo", b.Number+1)
+	if !ok || restarted.Parent != b.Number || restarted.Status != "running" {
+		t.Errorf("restarted build = %+v", restarted)
+	}
+}
+
+func TestKillBuild(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.Script("owner/repo", "running")
+	srv.AddRepo("owner/repo")
+	client := srv.Client()
+
+	b, err := client.CreateBuild("owner/repo", "master", nil)
+	if err != nil {
+		t.Fatalf("CreateBuild: %s", err)
+	}
+	if err := client.KillBuild("owner/repo", b.Number); err != nil {
+		t.Fatalf("KillBuild: %s", err)
+	}
+	got, err := client.GetBuild("owner/repo", b.Number)
+	if err != nil {
+		t.Fatalf("GetBuild: %s", err)
+	}
+	if got.Status != "killed" || got.Finished == 0 {
+		t.Errorf("killed build = %+v", got)
+	}
+}
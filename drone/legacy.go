@@ -0,0 +1,112 @@
+package drone
+
+import (
+	"net/http"
+
+	"github.com/drone/drone-go/drone"
+)
+
+// legacyClient speaks drone 0.8 API through drone-go.
+type legacyClient struct {
+	client drone.Client
+}
+
+func newLegacyClient(host string, auther *http.Client) *legacyClient {
+	return &legacyClient{drone.NewClient(host, auther)}
+}
+
+func newLegacyBuild(b *drone.Build) *Build {
+	return &Build{
+		Number:   b.Number,
+		Commit:   shortCommit(b.Commit),
+		Sha:      b.Commit,
+		Message:  b.Message,
+		Status:   b.Status,
+		Event:    b.Event,
+		Branch:   b.Branch,
+		Author:   b.Author,
+		Email:    b.Email,
+		Link:     b.Link,
+		Deploy:   b.Deploy,
+		Parent:   b.Parent,
+		Started:  b.Started,
+		Finished: b.Finished,
+	}
+}
+
+func (c *legacyClient) RepoList() ([]Repo, error) {
+	repos, err := c.client.RepoList()
+	if err != nil {
+		return nil, err
+	}
+	list := []Repo{}
+	for _, r := range repos {
+		list = append(list, Repo{r.Owner, r.Name})
+	}
+	return list, nil
+}
+
+func (c *legacyClient) BuildList(owner, name string) ([]*Build, error) {
+	list, err := c.client.BuildList(owner, name)
+	if err != nil {
+		return nil, err
+	}
+	builds := []*Build{}
+	for _, b := range list {
+		builds = append(builds, newLegacyBuild(b))
+	}
+	return builds, nil
+}
+
+func (c *legacyClient) Build(owner, name string, number int) (*Build, error) {
+	b, err := c.client.Build(owner, name, number)
+	if err != nil {
+		return nil, err
+	}
+	return newLegacyBuild(b), nil
+}
+
+func (c *legacyClient) BuildCreate(owner, name, branch string, params map[string]string) (*Build, error) {
+	return nil, ErrNotSupported
+}
+
+func (c *legacyClient) BuildRestart(owner, name string, number int, params map[string]string) (*Build, error) {
+	b, err := c.client.BuildStart(owner, name, number, params)
+	if err != nil {
+		return nil, err
+	}
+	return newLegacyBuild(b), nil
+}
+
+func (c *legacyClient) BuildCancel(owner, name string, number int) error {
+	return c.client.BuildKill(owner, name, number)
+}
+
+// BuildLogs returns logs of the job. step is ignored because 0.8 has no steps.
+func (c *legacyClient) BuildLogs(owner, name string, number, stage, step int) ([]string, error) {
+	logs, err := c.client.BuildLogs(owner, name, number, stage)
+	if err != nil {
+		return nil, err
+	}
+	lines := []string{}
+	for _, l := range logs {
+		lines = append(lines, l.Output)
+	}
+	return lines, nil
+}
+
+func (c *legacyClient) Promote(owner, name string, number int, target string, params map[string]string) (*Build, error) {
+	b, err := c.client.Deploy(owner, name, number, target, params)
+	if err != nil {
+		return nil, err
+	}
+	return newLegacyBuild(b), nil
+}
+
+func (c *legacyClient) CronList(owner, name string) ([]*Cron, error) {
+	return nil, ErrNotSupported
+}
+
+func (c *legacyClient) CronExec(owner, name, cron string) error {
+	return ErrNotSupported
+}
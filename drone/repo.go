@@ -10,10 +10,15 @@ type Repo struct {
 	Name  string
 }
 
-func GetRepoFromFullName(name string) *Repo {
+// GetRepoFromFullName parses {owner}/{name}.
+func GetRepoFromFullName(name string) (*Repo, error) {
 	strs := strings.Split(name, "/")
-	return &Repo{strs[0], strs[1]}
+	if len(strs) != 2 || strs[0] == "" || strs[1] == "" {
+		return nil, fmt.Errorf("invalid repository name %q. It must be {owner}/{name}", name)
+	}
+	return &Repo{strs[0], strs[1]}, nil
 }
+
 func (r *Repo) FullName() string {
 	return fmt.Sprintf("%s/%s", r.Owner, r.Name)
 }
@@ -0,0 +1,90 @@
+package drone
+
+import "sync"
+
+// Servers holds drone clients of several drone servers.
+// The first added server is used for repositories not bound to any server.
+type Servers struct {
+	mu      sync.RWMutex
+	servers map[string]Client
+	names   []string
+	// full name of repository -> server name
+	repos map[string]string
+}
+
+func NewServers() *Servers {
+	return &Servers{
+		servers: map[string]Client{},
+		repos:   map[string]string{},
+	}
+}
+
+func (s *Servers) Add(name string, d Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.servers[name]; !ok {
+		s.names = append(s.names, name)
+	}
+	s.servers[name] = d
+}
+
+func (s *Servers) Get(name string) (Client, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	d, ok := s.servers[name]
+	return d, ok
+}
+
+func (s *Servers) Names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string{}, s.names...)
+}
+
+// Bind makes the repository use the server.
+func (s *Servers) Bind(fullName, server string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.repos[fullName] = server
+}
+
+// ServerName returns the server name the repository uses.
+func (s *Servers) ServerName(fullName string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if name, ok := s.repos[fullName]; ok {
+		return name
+	}
+	if len(s.names) == 0 {
+		return ""
+	}
+	return s.names[0]
+}
+
+// ForRepo returns the drone client the repository uses.
+func (s *Servers) ForRepo(fullName string) Client {
+	d, _ := s.Get(s.ServerName(fullName))
+	return d
+}
+
+// GetRepositories returns repositories of all servers.
+// Found repositories are bound to the server which has it unless already bound.
+func (s *Servers) GetRepositories(owners []string) ([]Repo, error) {
+	list := []Repo{}
+	for _, name := range s.Names() {
+		d, _ := s.Get(name)
+		repos, err := d.GetRepositories(owners)
+		if err != nil {
+			return list, err
+		}
+		s.mu.Lock()
+		for _, r := range repos {
+			if _, ok := s.repos[r.FullName()]; !ok {
+				s.repos[r.FullName()] = name
+			}
+		}
+		s.mu.Unlock()
+		list = append(list, repos...)
+	}
+	return list, nil
+}
@@ -0,0 +1,253 @@
+package drone
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// v1Client speaks drone 1.x and 2.x API.
+type v1Client struct {
+	host   string
+	client *http.Client
+}
+
+type v1Repo struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+type v1Step struct {
+	Number int    `json:"number"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+type v1Stage struct {
+	Number int       `json:"number"`
+	Name   string    `json:"name"`
+	Status string    `json:"status"`
+	Steps  []*v1Step `json:"steps"`
+}
+
+type v1Build struct {
+	Number   int        `json:"number"`
+	Status   string     `json:"status"`
+	Event    string     `json:"event"`
+	Link     string     `json:"link"`
+	Message  string     `json:"message"`
+	After    string     `json:"after"`
+	Source   string     `json:"source"`
+	Target   string     `json:"target"`
+	Author   string     `json:"author_login"`
+	Email    string     `json:"author_email"`
+	Deploy   string     `json:"deploy_to"`
+	Parent   int        `json:"parent"`
+	Started  int64      `json:"started"`
+	Finished int64      `json:"finished"`
+	Stages   []*v1Stage `json:"stages"`
+}
+
+type v1Cron struct {
+	Name   string `json:"name"`
+	Expr   string `json:"expr"`
+	Branch string `json:"branch"`
+	Next   int64  `json:"next"`
+}
+
+type v1Line struct {
+	Out string `json:"out"`
+}
+
+func newV1Client(host string, auther *http.Client) *v1Client {
+	return &v1Client{strings.TrimSuffix(host, "/"), auther}
+}
+
+func newV1Build(b *v1Build) *Build {
+	build := &Build{
+		Number:   b.Number,
+		Commit:   shortCommit(b.After),
+		Sha:      b.After,
+		Message:  b.Message,
+		Status:   b.Status,
+		Event:    b.Event,
+		Branch:   b.Target,
+		Author:   b.Author,
+		Email:    b.Email,
+		Link:     b.Link,
+		Deploy:   b.Deploy,
+		Parent:   b.Parent,
+		Started:  b.Started,
+		Finished: b.Finished,
+	}
+	// target of pull requests is the base branch.
+	if b.Event == "pull_request" {
+		build.Branch = b.Source
+	}
+	for _, s := range b.Stages {
+		stage := Stage{Number: s.Number, Name: s.Name, Status: s.Status}
+		for _, st := range s.Steps {
+			stage.Steps = append(stage.Steps, Step{Number: st.Number, Name: st.Name, Status: st.Status})
+		}
+		build.Stages = append(build.Stages, stage)
+	}
+	return build
+}
+
+func (c *v1Client) do(method, path string, query url.Values, out interface{}) error {
+	uri := c.host + path
+	if len(query) != 0 {
+		uri += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, uri, nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusMultipleChoices {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("drone: %s %s: %d %s", method, path, res.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func (c *v1Client) RepoList() ([]Repo, error) {
+	var repos []*v1Repo
+	if err := c.do(http.MethodGet, "/api/user/repos", nil, &repos); err != nil {
+		return nil, err
+	}
+	list := []Repo{}
+	for _, r := range repos {
+		list = append(list, Repo{r.Namespace, r.Name})
+	}
+	return list, nil
+}
+
+func (c *v1Client) BuildList(owner, name string) ([]*Build, error) {
+	var list []*v1Build
+	path := fmt.Sprintf("/api/repos/%s/%s/builds", owner, name)
+	if err := c.do(http.MethodGet, path, nil, &list); err != nil {
+		return nil, err
+	}
+	builds := []*Build{}
+	for _, b := range list {
+		builds = append(builds, newV1Build(b))
+	}
+	return builds, nil
+}
+
+func (c *v1Client) Build(owner, name string, number int) (*Build, error) {
+	var b v1Build
+	path := fmt.Sprintf("/api/repos/%s/%s/builds/%d", owner, name, number)
+	if err := c.do(http.MethodGet, path, nil, &b); err != nil {
+		return nil, err
+	}
+	return newV1Build(&b), nil
+}
+
+func (c *v1Client) BuildCreate(owner, name, branch string, params map[string]string) (*Build, error) {
+	var b v1Build
+	path := fmt.Sprintf("/api/repos/%s/%s/builds", owner, name)
+	query := mapToQuery(params)
+	query.Set("branch", branch)
+	if err := c.do(http.MethodPost, path, query, &b); err != nil {
+		return nil, err
+	}
+	return newV1Build(&b), nil
+}
+
+func (c *v1Client) BuildRestart(owner, name string, number int, params map[string]string) (*Build, error) {
+	var b v1Build
+	path := fmt.Sprintf("/api/repos/%s/%s/builds/%d", owner, name, number)
+	if err := c.do(http.MethodPost, path, mapToQuery(params), &b); err != nil {
+		return nil, err
+	}
+	return newV1Build(&b), nil
+}
+
+func (c *v1Client) BuildCancel(owner, name string, number int) error {
+	path := fmt.Sprintf("/api/repos/%s/%s/builds/%d", owner, name, number)
+	return c.do(http.MethodDelete, path, nil, nil)
+}
+
+func (c *v1Client) BuildLogs(owner, name string, number, stage, step int) ([]string, error) {
+	var logs []*v1Line
+	path := fmt.Sprintf("/api/repos/%s/%s/builds/%d/logs/%d/%d", owner, name, number, stage, step)
+	if err := c.do(http.MethodGet, path, nil, &logs); err != nil {
+		return nil, err
+	}
+	lines := []string{}
+	for _, l := range logs {
+		lines = append(lines, l.Out)
+	}
+	return lines, nil
+}
+
+func (c *v1Client) Promote(owner, name string, number int, target string, params map[string]string) (*Build, error) {
+	var b v1Build
+	path := fmt.Sprintf("/api/repos/%s/%s/builds/%d/promote", owner, name, number)
+	query := mapToQuery(params)
+	query.Set("target", target)
+	if err := c.do(http.MethodPost, path, query, &b); err != nil {
+		return nil, err
+	}
+	return newV1Build(&b), nil
+}
+
+func (c *v1Client) CronList(owner, name string) ([]*Cron, error) {
+	var list []*v1Cron
+	path := fmt.Sprintf("/api/repos/%s/%s/cron", owner, name)
+	if err := c.do(http.MethodGet, path, nil, &list); err != nil {
+		return nil, err
+	}
+	crons := []*Cron{}
+	for _, c := range list {
+		crons = append(crons, &Cron{Name: c.Name, Expr: c.Expr, Branch: c.Branch, Next: c.Next})
+	}
+	return crons, nil
+}
+
+func (c *v1Client) CronExec(owner, name, cron string) error {
+	path := fmt.Sprintf("/api/repos/%s/%s/cron/%s", owner, name, cron)
+	return c.do(http.MethodPost, path, nil, nil)
+}
+
+func mapToQuery(params map[string]string) url.Values {
+	query := url.Values{}
+	for k, v := range params {
+		query.Set(k, v)
+	}
+	return query
+}
+
+// detectVersion asks the drone server its version.
+func detectVersion(host string, client *http.Client) (string, error) {
+	res, err := client.Get(strings.TrimSuffix(host, "/") + "/version")
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("drone: GET /version: %d", res.StatusCode)
+	}
+
+	var v struct {
+		Version string `json:"version"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+		return "", err
+	}
+	return parseVersion(v.Version)
+}
@@ -0,0 +1,134 @@
+package drone
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// webhookMaxAge is the allowed difference of Date header and the current time.
+const webhookMaxAge = 5 * time.Minute
+
+// ErrInvalidSignature is returned when the webhook is not signed by the secret.
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// WebhookEvent is a build event sent by drone 1.x global webhook.
+type WebhookEvent struct {
+	// Event is build, repo or user. Only build has Build.
+	Event string
+	// Action is created or updated.
+	Action string
+	// Repo is the full name of the repository.
+	Repo  string
+	Build *Build
+}
+
+type v1Webhook struct {
+	Event  string `json:"event"`
+	Action string `json:"action"`
+	Repo   struct {
+		Slug string `json:"slug"`
+	} `json:"repo"`
+	Build *v1Build `json:"build"`
+}
+
+// ParseWebhook verifies the signature of the request and parses the body.
+// The request is signed by HTTP Signatures with hmac-sha256 of secret (DRONE_WEBHOOK_SECRET)
+// and the body is verified by Digest header.
+func ParseWebhook(r *http.Request, secret string) (*WebhookEvent, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(r, secret); err != nil {
+		return nil, err
+	}
+	if err := verifyDigest(r.Header.Get("Digest"), body); err != nil {
+		return nil, err
+	}
+
+	var hook v1Webhook
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&hook); err != nil {
+		return nil, err
+	}
+	ev := &WebhookEvent{Event: hook.Event, Action: hook.Action, Repo: hook.Repo.Slug}
+	if hook.Build != nil {
+		ev.Build = newV1Build(hook.Build)
+	}
+	return ev, nil
+}
+
+// verifySignature verifies Signature header.
+// e.g. keyId="hmac-key",algorithm="hmac-sha256",headers="date digest",signature="..."
+func verifySignature(r *http.Request, secret string) error {
+	header := r.Header.Get("Signature")
+	if header == "" {
+		header = strings.TrimPrefix(r.Header.Get("Authorization"), "Signature ")
+	}
+	params := map[string]string{}
+	for _, kv := range strings.Split(header, ",") {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			continue
+		}
+		params[strings.TrimSpace(kv[:i])] = strings.Trim(strings.TrimSpace(kv[i+1:]), `"`)
+	}
+	if params["algorithm"] != "hmac-sha256" || params["signature"] == "" {
+		return ErrInvalidSignature
+	}
+	headers := strings.Fields(params["headers"])
+	if len(headers) == 0 {
+		headers = []string{"date"}
+	}
+	// The body must be covered by the signature through Digest.
+	signed := false
+	lines := make([]string, len(headers))
+	for i, h := range headers {
+		h = strings.ToLower(h)
+		if h == "(request-target)" {
+			lines[i] = fmt.Sprintf("%s: %s %s", h, strings.ToLower(r.Method), r.URL.RequestURI())
+			continue
+		}
+		if h == "digest" {
+			signed = true
+		}
+		lines[i] = fmt.Sprintf("%s: %s", h, r.Header.Get(h))
+	}
+	if !signed {
+		return ErrInvalidSignature
+	}
+	// Reject replayed requests.
+	if date, err := http.ParseTime(r.Header.Get("Date")); err != nil || time.Since(date) > webhookMaxAge || time.Until(date) > webhookMaxAge {
+		return ErrInvalidSignature
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join(lines, "\n")))
+	expected := mac.Sum(nil)
+	actual, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil || !hmac.Equal(expected, actual) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// verifyDigest verifies Digest header. e.g. SHA-256=base64(sha256(body))
+func verifyDigest(header string, body []byte) error {
+	if !strings.HasPrefix(header, "SHA-256=") {
+		return ErrInvalidSignature
+	}
+	sum := sha256.Sum256(body)
+	actual, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(header, "SHA-256="))
+	if err != nil || !hmac.Equal(sum[:], actual) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/vivitInc/maguro/drone"
+)
+
+// BuildEvent is a build created or updated in drone.
+type BuildEvent struct {
+	Repo  string
+	Build *drone.Build
+}
+
+// BuildEvents delivers build events received by drone webhook to subscribers.
+type BuildEvents struct {
+	// enabled is true if the webhook is configured.
+	enabled bool
+
+	mu     sync.Mutex
+	nextID int
+	subs   map[int]*buildSubscription
+}
+
+type buildSubscription struct {
+	// repo is the full name of repository. Events of all repositories are delivered if empty.
+	repo string
+	// number is the build number. Events of all builds of repo are delivered if 0.
+	number int
+	ch     chan BuildEvent
+}
+
+func NewBuildEvents(enabled bool) *BuildEvents {
+	return &BuildEvents{enabled: enabled, subs: map[int]*buildSubscription{}}
+}
+
+// Enabled reports whether events come. Subscribers poll drone if not.
+func (e *BuildEvents) Enabled() bool {
+	return e.enabled
+}
+
+// Subscribe returns events of the build. All builds of repo if number is 0,
+// and all repositories if repo is empty.
+// Call the returned function to unsubscribe.
+func (e *BuildEvents) Subscribe(repo string, number int) (<-chan BuildEvent, func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	id := e.nextID
+	e.nextID++
+	sub := &buildSubscription{repo: repo, number: number, ch: make(chan BuildEvent, 16)}
+	e.subs[id] = sub
+	return sub.ch, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		delete(e.subs, id)
+	}
+}
+
+// Publish delivers the event. Events are dropped for subscribers not receiving them in time.
+func (e *BuildEvents) Publish(ev BuildEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, sub := range e.subs {
+		if (sub.repo != "" && sub.repo != ev.Repo) || (sub.number != 0 && sub.number != ev.Build.Number) {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+
+	"github.com/vivitInc/maguro/leader"
+	"go.uber.org/zap"
+)
+
+// forwardedHeader marks requests forwarded to the leader so that they are never forwarded again.
+// Format: {id} {hex of HMAC-SHA256 of id by FORWARD_SECRET}
+const forwardedHeader = "X-Maguro-Forwarded-From"
+
+// leaderOnly serves requests on the leader and forwards them from followers to the leader,
+// because deploys, scheduled deploys and their queues live in the leader.
+type leaderOnly struct {
+	elector *leader.Elector
+	handler http.Handler
+	// secret signs forwardedHeader. Requests are not trusted as forwarded without it.
+	secret string
+}
+
+func (h leaderOnly) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.forwarded(r) {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	r.Header.Del(forwardedHeader)
+
+	id, self := h.waitLeader(r.Context())
+	if self {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	addr := leaderAddr(id)
+	if addr == "" {
+		logger.Error("Failed to forward request to leader", zap.String("path", r.URL.Path), zap.String("leader", id))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = addr
+			req.Header.Set(forwardedHeader, h.elector.ID+" "+h.sign(h.elector.ID))
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// waitLeader waits for a leader with the address for leaderWaitTimeout,
+// because there is no leader before the first election and while the lease expires.
+func (h leaderOnly) waitLeader(ctx context.Context) (string, bool) {
+	deadline := time.Now().Add(leaderWaitTimeout)
+	for {
+		id, self := h.elector.Leader()
+		if self || leaderAddr(id) != "" || !time.Now().Before(deadline) {
+			return id, self
+		}
+		select {
+		case <-time.After(leaderPollInterval):
+		case <-ctx.Done():
+			return id, self
+		}
+	}
+}
+
+// forwarded reports whether the request is forwarded by another replica.
+func (h leaderOnly) forwarded(r *http.Request) bool {
+	v := r.Header.Get(forwardedHeader)
+	i := strings.LastIndex(v, " ")
+	if h.secret == "" || i < 0 {
+		return false
+	}
+	return hmac.Equal([]byte(v[i+1:]), []byte(h.sign(v[:i])))
+}
+
+func (h leaderOnly) sign(id string) string {
+	mac := hmac.New(sha256.New, []byte(h.secret))
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// leaderAddr returns the address in the leader ID. Format: {name}@{host}:{port}
+// Empty if the leader is unknown or doesn't tell its address.
+func leaderAddr(id string) string {
+	i := strings.LastIndex(id, "@")
+	if i < 0 {
+		return ""
+	}
+	return id[i+1:]
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vivitInc/maguro/leader"
+	"go.uber.org/zap"
+)
+
+// testLock is held by holder.
+type testLock struct {
+	mu     sync.Mutex
+	holder string
+}
+
+func (l *testLock) set(holder string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.holder = holder
+}
+
+func (l *testLock) Acquire(id string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.holder == id, nil
+}
+
+func (l *testLock) Release(id string) error { return nil }
+
+func (l *testLock) Holder() (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.holder, nil
+}
+
+// runElector runs an elector of id until the returned func is called.
+func runElector(lock leader.Lock, id string) (*leader.Elector, func()) {
+	e := &leader.Elector{Lock: lock, ID: id, RetryPeriod: 10 * time.Millisecond}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		e.Run(stop, func(lost <-chan struct{}) { <-lost })
+		close(done)
+	}()
+	return e, func() {
+		close(stop)
+		<-done
+	}
+}
+
+// servedBy answers the name of the replica with the forwarded header it received.
+func servedBy(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name + ":" + r.Header.Get(forwardedHeader)))
+	})
+}
+
+func get(t *testing.T, url string, header http.Header) (int, string) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = header
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(body)
+}
+
+func TestLeaderOnlyForward(t *testing.T) {
+	logger = zap.NewNop()
+	const secret = "forward-secret"
+	lock := &testLock{}
+
+	leaderSrv := httptest.NewUnstartedServer(nil)
+	leaderID := "leader@" + leaderSrv.Listener.Addr().String()
+	leaderElector, stopLeader := runElector(lock, leaderID)
+	defer stopLeader()
+	leaderSrv.Config.Handler = leaderOnly{elector: leaderElector, secret: secret, handler: servedBy("leader")}
+	leaderSrv.Start()
+	defer leaderSrv.Close()
+
+	followerElector, stopFollower := runElector(lock, "follower@127.0.0.1:1")
+	defer stopFollower()
+	follower := httptest.NewServer(leaderOnly{elector: followerElector, secret: secret, handler: servedBy("follower")})
+	defer follower.Close()
+
+	// No leader is elected yet. The follower waits for it.
+	time.AfterFunc(200*time.Millisecond, func() { lock.set(leaderID) })
+	code, body := get(t, follower.URL, http.Header{})
+	signed := "follower@127.0.0.1:1 " + leaderOnly{secret: secret}.sign("follower@127.0.0.1:1")
+	if code != http.StatusOK || body != "leader:"+signed {
+		t.Errorf("request before election = %d %q", code, body)
+	}
+
+	// A forged header doesn't keep the request in the follower.
+	for _, forged := range []string{"leader", "leader deadbeef", "follower@127.0.0.1:1 " + leaderOnly{secret: "other"}.sign("follower@127.0.0.1:1")} {
+		code, body = get(t, follower.URL, http.Header{forwardedHeader: {forged}})
+		if code != http.StatusOK || body != "leader:"+signed {
+			t.Errorf("request with %q = %d %q", forged, code, body)
+		}
+	}
+
+	// The leader drops the forged header before serving.
+	code, body = get(t, leaderSrv.URL, http.Header{forwardedHeader: {"leader deadbeef"}})
+	if code != http.StatusOK || body != "leader:" {
+		t.Errorf("request to leader = %d %q", code, body)
+	}
+}
+
+func TestLeaderOnlyNoLeader(t *testing.T) {
+	logger = zap.NewNop()
+	e, stop := runElector(&testLock{}, "follower@127.0.0.1:1")
+	defer stop()
+	srv := httptest.NewServer(leaderOnly{elector: e, secret: "forward-secret", handler: servedBy("follower")})
+	defer srv.Close()
+
+	start := time.Now()
+	if code, body := get(t, srv.URL, http.Header{}); code != http.StatusServiceUnavailable {
+		t.Errorf("request without leader = %d %q", code, body)
+	}
+	if waited := time.Since(start); waited < leaderWaitTimeout {
+		t.Errorf("waited %s for leader", waited)
+	}
+}
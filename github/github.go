@@ -0,0 +1,190 @@
+// Package github is a small client of GitHub REST API v3.
+// BaseURL can point to GitHub Enterprise or a local stand-in server.
+package github
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultBaseURL is the API URL of github.com.
+const DefaultBaseURL = "https://api.github.com"
+
+// Slack requires responses of interactive messages in 3 seconds.
+const requestTimeout = 2 * time.Second
+
+type Client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// NewClient returns a client of the API at baseURL.
+// Requests are not authenticated if token is empty.
+func NewClient(baseURL, token string) *Client {
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	return &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		http:    &http.Client{Timeout: requestTimeout},
+	}
+}
+
+// Commit is a commit of compare API.
+type Commit struct {
+	SHA     string
+	Message string
+	// Author is the login of GitHub. Empty if the email is not linked to any user.
+	Author string
+	// Name is the author name of the commit.
+	Name string
+	URL  string
+}
+
+type commitJSON struct {
+	SHA     string `json:"sha"`
+	HTMLURL string `json:"html_url"`
+	Commit  struct {
+		Message string `json:"message"`
+		Author  struct {
+			Name string `json:"name"`
+		} `json:"author"`
+	} `json:"commit"`
+	Author *struct {
+		Login string `json:"login"`
+	} `json:"author"`
+}
+
+// Comparison is the result of compare API.
+type Comparison struct {
+	// Status is ahead, behind, diverged or identical.
+	Status string
+	// Commits are reachable from head but not from base, oldest first.
+	Commits []Commit
+}
+
+// Compare compares head with base.
+// repo format: {owner}/{name}
+func (c *Client) Compare(repo, base, head string) (*Comparison, error) {
+	var res struct {
+		Status  string       `json:"status"`
+		Commits []commitJSON `json:"commits"`
+	}
+	if err := c.do(http.MethodGet, fmt.Sprintf("/repos/%s/compare/%s...%s", repo, base, head), nil, &res); err != nil {
+		return nil, err
+	}
+	commits := make([]Commit, len(res.Commits))
+	for i, cj := range res.Commits {
+		commits[i] = Commit{
+			SHA:     cj.SHA,
+			Message: cj.Commit.Message,
+			Name:    cj.Commit.Author.Name,
+			URL:     cj.HTMLURL,
+		}
+		if cj.Author != nil {
+			commits[i].Author = cj.Author.Login
+		}
+	}
+	return &Comparison{Status: res.Status, Commits: commits}, nil
+}
+
+// do sends in as JSON and decodes the response into out if they are not nil.
+func (c *Client) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		buf, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "token "+c.token)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("github: %s %s: %d %s", method, path, res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// Deployment states of CreateDeploymentStatus.
+const (
+	DeploymentInProgress = "in_progress"
+	DeploymentSuccess    = "success"
+	DeploymentFailure    = "failure"
+	DeploymentError      = "error"
+)
+
+// Deployment is a request to deploy Ref to Environment.
+type Deployment struct {
+	Ref         string
+	Environment string
+	Description string
+	// Payload is extra data for deploy tools.
+	Payload map[string]string
+}
+
+// CreateDeployment creates the deployment and returns its ID.
+// Commit statuses are not checked and the default branch is not merged
+// because the build to deploy has already passed CI.
+func (c *Client) CreateDeployment(repo string, d Deployment) (int64, error) {
+	in := map[string]interface{}{
+		"ref":               d.Ref,
+		"environment":       d.Environment,
+		"description":       d.Description,
+		"payload":           d.Payload,
+		"auto_merge":        false,
+		"required_contexts": []string{},
+	}
+	var res struct {
+		ID int64 `json:"id"`
+	}
+	if err := c.do(http.MethodPost, fmt.Sprintf("/repos/%s/deployments", repo), in, &res); err != nil {
+		return 0, err
+	}
+	return res.ID, nil
+}
+
+// DeploymentStatus is a status of the deployment.
+type DeploymentStatus struct {
+	// State is one of Deployment* constants.
+	State       string
+	LogURL      string
+	Description string
+}
+
+// CreateDeploymentStatus updates the state of the deployment.
+func (c *Client) CreateDeploymentStatus(repo string, id int64, s DeploymentStatus) error {
+	in := map[string]string{
+		"state":       s.State,
+		"log_url":     s.LogURL,
+		"description": s.Description,
+	}
+	return c.do(http.MethodPost, fmt.Sprintf("/repos/%s/deployments/%d/statuses", repo, id), in, nil)
+}
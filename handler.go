@@ -14,10 +14,15 @@ import (
 
 // interactionHandler handles interactive message response.
 type interactionHandler struct {
-	slack             *slack.Client
+	slack             slackClient
 	verificationToken string
-	drone             *drone.Drone
-	config            *config.Config
+	drone             *drone.Servers
+	config            *config.Store
+	deploys           *DeployScheduler
+	watcher           *DeployWatcher
+	queue             *DeployQueue
+	events            *BuildEvents
+	users             *UserDirectory
 }
 
 func (h interactionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -28,8 +33,12 @@ func (h interactionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	action := message.Actions[0]
-	build := Build{slack: h.slack, drone: h.drone}
-	deploy := Deploy{slack: h.slack, drone: h.drone, config: h.config}
+	interactionsTotal.Inc(action.Name)
+	// The deploy confirmation is answered, so its changelog must not overwrite the answer.
+	pendingChangelogs.cancel(message.MessageTs)
+	conf := h.config.Get()
+	build := Build{slack: h.slack, drone: h.drone, config: conf}
+	deploy := Deploy{slack: h.slack, drone: h.drone, config: h.config, deploys: h.deploys, watcher: h.watcher, events: h.events, users: h.users, queue: h.queue}
 	switch action.Name {
 	case BuildActionSelectRepo:
 		responseMessage(w, build.SelectBuild(message))
@@ -47,6 +56,8 @@ func (h interactionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		responseMessage(w, deploy.Confirm(message))
 	case DeployActionConfirm:
 		responseMessage(w, deploy.Deploy(message))
+	case DeployActionSchedule:
+		responseMessage(w, deploy.Schedule(message))
 	case ActionCancel:
 		originalMessage := message.OriginalMessage
 		originalMessage.Attachments = Message("やっぱりやめた！", "")
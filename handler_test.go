@@ -0,0 +1,302 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/vivitInc/maguro/config"
+	"github.com/vivitInc/maguro/drone"
+	"github.com/vivitInc/maguro/drone/dronetest"
+	"github.com/vivitInc/maguro/slacktest"
+	"github.com/vivitInc/maguro/statestore"
+	"go.uber.org/zap"
+)
+
+const (
+	testToken   = "verification-token"
+	testChannel = "C0001"
+	testUser    = "U0001"
+)
+
+// waitStatus waits until the deploy watcher reads the build as status.
+func waitStatus(t *testing.T, srv *dronetest.Server, repo string, number int, status string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if b, ok := srv.Build(repo, number); ok && b.Status == status {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("build #%d didn't become %s", number, status)
+}
+
+// testInteraction is the interaction handler connected to fake Slack and drone servers.
+type testInteraction struct {
+	dir     string
+	slack   *slacktest.Server
+	drone   *dronetest.Server
+	handler interactionHandler
+	harness *slacktest.Harness
+}
+
+func newTestInteraction(t *testing.T) *testInteraction {
+	logger = zap.NewNop()
+	dir, err := ioutil.TempDir("", "maguro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ti := &testInteraction{dir: dir, slack: slacktest.NewServer(), drone: dronetest.NewServer()}
+	slack.SLACK_API = ti.slack.APIURL()
+	api := slack.New("bot-token")
+	servers := drone.NewServers()
+	servers.Add(defaultDroneServer, ti.drone.Client())
+
+	store := config.NewStore(&config.Config{
+		Repositories: []config.Repository{{Name: "owner/repo", Env: []string{"staging", "production"}}},
+	})
+	deploys, err := NewDeployScheduler(statestore.Dir(dir), func(ScheduledDeploy) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := NewDeployWatcher(statestore.Dir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue, err := NewDeployQueue(statestore.Dir(dir), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ti.handler = interactionHandler{
+		slack:             api,
+		verificationToken: testToken,
+		drone:             servers,
+		config:            store,
+		deploys:           deploys,
+		watcher:           watcher,
+		queue:             queue,
+		events:            NewBuildEvents(true),
+		users:             NewUserDirectory(store, api, "bot-token"),
+	}
+	ti.harness = &slacktest.Harness{Handler: ti.handler, Token: testToken, Channel: testChannel, User: testUser, ResponseURL: ti.slack.ResponseURL()}
+	return ti
+}
+
+func (ti *testInteraction) Close() {
+	ti.slack.Close()
+	ti.drone.Close()
+	os.RemoveAll(ti.dir)
+}
+
+func (ti *testInteraction) deploy() *Deploy {
+	h := ti.handler
+	return &Deploy{slack: h.slack, drone: h.drone, config: h.config, deploys: h.deploys, watcher: h.watcher, events: h.events, users: h.users, queue: h.queue}
+}
+
+// start returns the first message posted by fn.
+func (ti *testInteraction) start(t *testing.T, fn func(event *slack.MessageEvent)) *slack.Message {
+	fn(&slack.MessageEvent{Msg: slack.Msg{Channel: testChannel}})
+	messages, err := ti.slack.WaitMessages(1, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ti.harness.Start(messages[0])
+}
+
+func TestInteractionHandlerDeploy(t *testing.T) {
+	ti := newTestInteraction(t)
+	defer ti.Close()
+	ti.drone.AddBuild("owner/repo", dronetest.Build{Branch: "master", Commit: "aaa", Message: "first"})
+	ti.drone.AddBuild("owner/repo", dronetest.Build{Branch: "master", Commit: "aaa", Event: "promote", Deploy: "production", Parent: 1})
+	ti.drone.AddBuild("owner/repo", dronetest.Build{Branch: "master", Commit: "bbb", Message: "second"})
+	ti.drone.Script("owner/repo", "pending", "running", "success")
+	h, slackServer, droneServer := ti.harness, ti.slack, ti.drone
+	queue, events := ti.handler.queue, ti.handler.events
+
+	deploy := ti.deploy()
+	msg := ti.start(t, func(event *slack.MessageEvent) { deploy.SelectRepo(event, time.Time{}) })
+
+	msg, err := h.Select(msg, DeployActionSelectRepo, "owner/repo")
+	if err != nil {
+		t.Fatalf("select repo: %s", err)
+	}
+	if got := msg.Attachments[0].Text; got != "owner/repoのどの環境？" {
+		t.Errorf("text after repo = %s", got)
+	}
+
+	msg, err = h.Select(msg, DeployActionSelectEnv, "owner/repo:production")
+	if err != nil {
+		t.Fatalf("select env: %s", err)
+	}
+	if got := msg.Attachments[0].Text; got != "owner/repoのどのビルド？" {
+		t.Errorf("text after env = %s", got)
+	}
+
+	msg, err = h.Select(msg, DeployActionSelectBuild, "owner/repo:production:3")
+	if err != nil {
+		t.Fatalf("select build: %s", err)
+	}
+	if got := msg.Attachments[0].Text; got != "デプロイしていい？" {
+		t.Errorf("text after build = %s", got)
+	}
+	if len(msg.Attachments) != 2 || msg.Attachments[1].Text != "変更内容を調べてるよ..." {
+		t.Errorf("changelog placeholder = %+v", msg.Attachments)
+	}
+
+	// The changelog replaces the confirmation through the response URL.
+	messages, err := slackServer.WaitMessages(2, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changelog := messages[1]
+	if changelog.Method != "response_url" || changelog.Channel != testChannel || len(changelog.Attachments) != 2 {
+		t.Fatalf("changelog = %+v", changelog)
+	}
+	if got := changelog.Attachments[1].Title; got != "デプロイされる変更 (#2 → #3)" {
+		t.Errorf("changelog title = %s", got)
+	}
+	if got := changelog.Attachments[1].Text; !strings.Contains(got, "second") || strings.Contains(got, "first") {
+		t.Errorf("changelog text = %s", got)
+	}
+
+	msg, err = h.Click(msg, DeployActionConfirm)
+	if err != nil {
+		t.Fatalf("confirm: %s", err)
+	}
+	if got := msg.Attachments[0].Text; !strings.HasPrefix(got, "デプロイ始めたよ！") {
+		t.Errorf("text after confirm = %s", got)
+	}
+	b, ok := droneServer.Build("owner/repo", 4)
+	if !ok || b.Event != "promote" || b.Deploy != "production" || b.Parent != 3 {
+		t.Fatalf("deploy build = %+v", b)
+	}
+	if _, ok := queue.Running("owner/repo", "production"); !ok {
+		t.Errorf("deploy is not running in the queue")
+	}
+
+	// drone sends the finished build by webhook.
+	waitStatus(t, droneServer, "owner/repo", 4, "running")
+	finished, err := droneServer.Client().GetBuild("owner/repo", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events.Publish(BuildEvent{Repo: "owner/repo", Build: finished})
+
+	messages, err = slackServer.WaitMessages(4, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := messages[2]
+	if result.Method != "response_url" || result.Channel != testChannel || len(result.Attachments) != 1 {
+		t.Fatalf("result = %+v", result)
+	}
+	if result.Attachments[0].Color != "good" {
+		t.Errorf("result color = %s", result.Attachments[0].Color)
+	}
+	done := messages[3]
+	if done.Method != "chat.postMessage" || done.ThreadTimestamp != messages[0].Timestamp || !strings.Contains(done.Attachments[0].Text, "デプロイ終わったよー") {
+		t.Errorf("done = %+v", done)
+	}
+
+	for i := 0; i < 100; i++ {
+		if _, ok := queue.Running("owner/repo", "production"); !ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("deploy is still running in the queue")
+}
+
+func TestInteractionHandlerBuild(t *testing.T) {
+	ti := newTestInteraction(t)
+	defer ti.Close()
+	ti.drone.AddBuild("owner/repo", dronetest.Build{Branch: "master", Status: "running"})
+	ti.drone.AddBuild("owner/repo", dronetest.Build{Branch: "feature", Status: "running"})
+	ti.drone.Script("owner/repo", "pending")
+	build := Build{slack: ti.handler.slack, drone: ti.handler.drone, config: ti.handler.config.Get()}
+	h := ti.harness
+
+	// Restart cancels the running build and starts it again.
+	msg := ti.start(t, build.SelectRepo)
+	msg, err := h.Select(msg, BuildActionSelectRepo, "owner/repo")
+	if err != nil {
+		t.Fatalf("select repo: %s", err)
+	}
+	msg, err = h.Select(msg, BuildActionSelectBuild, "owner/repo:1")
+	if err != nil {
+		t.Fatalf("select build: %s", err)
+	}
+	msg, err = h.Click(msg, BuildActionRestart)
+	if err != nil {
+		t.Fatalf("restart: %s", err)
+	}
+	if got := msg.Attachments[0].Text; got != "1を再実行したよ！" {
+		t.Errorf("text after restart = %s", got)
+	}
+	if b, _ := ti.drone.Build("owner/repo", 1); b.Status != "killed" {
+		t.Errorf("status of restarted build = %s", b.Status)
+	}
+	if b, ok := ti.drone.Build("owner/repo", 3); !ok || b.Parent != 1 || b.Status != "pending" {
+		t.Errorf("new build = %+v", b)
+	}
+
+	// Stop kills the running build.
+	msg, err = h.Select(ti.harness.Start(ti.slack.Messages()[0]), BuildActionSelectRepo, "owner/repo")
+	if err != nil {
+		t.Fatalf("select repo: %s", err)
+	}
+	msg, err = h.Select(msg, BuildActionSelectBuild, "owner/repo:2")
+	if err != nil {
+		t.Fatalf("select build: %s", err)
+	}
+	msg, err = h.Click(msg, BuildActionStop)
+	if err != nil {
+		t.Fatalf("stop: %s", err)
+	}
+	if got := msg.Attachments[0].Text; got != "2を止めたよ！" {
+		t.Errorf("text after stop = %s", got)
+	}
+	if b, _ := ti.drone.Build("owner/repo", 2); b.Status != "killed" {
+		t.Errorf("status of stopped build = %s", b.Status)
+	}
+}
+
+func TestDeployRunScheduleWaitsForRunningDeploy(t *testing.T) {
+	ti := newTestInteraction(t)
+	defer ti.Close()
+	ti.drone.AddBuild("owner/repo", dronetest.Build{Branch: "master", Commit: "aaa"})
+	ti.drone.Script("owner/repo", "pending", "running")
+	deploy := ti.deploy()
+	s := config.Schedule{Name: "nightly", Type: config.ScheduleDeployBuildToEnv, Repo: "owner/repo", Env: "production", ReportChannel: testChannel}
+
+	first, err := deploy.RunSchedule(s, 1)
+	if err != nil || first == nil || first.Number != 2 {
+		t.Fatalf("first deploy = %+v, %v", first, err)
+	}
+	second, err := deploy.RunSchedule(s, 1)
+	if err != nil || second != nil {
+		t.Fatalf("second deploy = %+v, %v", second, err)
+	}
+	if _, queued := ti.handler.queue.List(); len(queued) != 1 {
+		t.Fatalf("queued deploys = %+v", queued)
+	}
+
+	// The queued deploy starts when the running one finishes.
+	waitStatus(t, ti.drone, "owner/repo", 2, "running")
+	ti.handler.events.Publish(BuildEvent{Repo: "owner/repo", Build: &drone.Build{Number: 2, Status: "success"}})
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if b, ok := ti.drone.Build("owner/repo", 3); ok {
+			if b.Event != "promote" || b.Deploy != "production" || b.Parent != 1 {
+				t.Errorf("queued deploy build = %+v", b)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("queued deploy didn't start")
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vivitInc/maguro/drone"
+	"go.uber.org/zap"
+)
+
+const (
+	// slackDownLimit is how long RTM can be disconnected before liveness fails.
+	// RTM reconnects by itself, so the process is restarted only if it seems stuck.
+	slackDownLimit = 5 * time.Minute
+	// droneDownLimit is how long drone API can keep failing before readiness fails.
+	droneDownLimit = 1 * time.Minute
+	// droneProbeInterval is the interval of checking drone servers actively.
+	// Readiness must not depend only on requests because a replica which is not ready gets no request.
+	droneProbeInterval = 20 * time.Second
+)
+
+// Health keeps state of dependencies for liveness and readiness checks.
+type Health struct {
+	now func() time.Time
+
+	// scheduler is asked its state on each check.
+	scheduler *Scheduler
+
+	mu             sync.Mutex
+	leader         bool
+	slackConnected bool
+	slackChangedAt time.Time
+	slackError     string
+	droneSuccessAt time.Time
+	droneErrorAt   time.Time
+	droneError     string
+	configLoadedAt time.Time
+	configError    string
+}
+
+// HealthCheck is a result of a dependency.
+type HealthCheck struct {
+	OK     bool                   `json:"ok"`
+	Detail map[string]interface{} `json:"detail"`
+}
+
+// HealthReport is the response of health check endpoints.
+type HealthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+func NewHealth() *Health {
+	now := time.Now()
+	return &Health{now: time.Now, slackChangedAt: now, configLoadedAt: now}
+}
+
+// SetLeader records whether this replica is the leader.
+// Only the leader connects to Slack RTM and runs schedules.
+func (h *Health) SetLeader(leader bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.leader = leader
+	h.slackConnected = false
+	h.slackChangedAt = h.now()
+}
+
+func (h *Health) SlackConnected(connected bool, reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.slackConnected != connected {
+		h.slackChangedAt = h.now()
+	}
+	h.slackConnected = connected
+	h.slackError = reason
+}
+
+func (h *Health) DroneCalled(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		h.droneErrorAt = h.now()
+		h.droneError = err.Error()
+		return
+	}
+	h.droneSuccessAt = h.now()
+}
+
+// ProbeDrone pings all drone servers until stop is closed.
+// Results are recorded by DroneCalled through instrumentedDrone.
+func (h *Health) ProbeDrone(servers *drone.Servers, stop <-chan struct{}) {
+	ticker := time.NewTicker(droneProbeInterval)
+	defer ticker.Stop()
+	for {
+		for _, name := range servers.Names() {
+			if c, ok := servers.Get(name); ok {
+				if err := c.Ping(); err != nil {
+					logger.Warn("Failed to ping drone", zap.String("server", name), zap.String("detail", err.Error()))
+				}
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (h *Health) ConfigLoaded(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		h.configError = err.Error()
+		return
+	}
+	h.configLoadedAt = h.now()
+	h.configError = ""
+}
+
+// slackDown returns how long RTM has been disconnected. 0 if it is not expected to be connected.
+// h.mu must be held.
+func (h *Health) slackDown() time.Duration {
+	if !h.leader || h.slackConnected {
+		return 0
+	}
+	return h.now().Sub(h.slackChangedAt)
+}
+
+// droneDown reports drone API keeps failing. h.mu must be held.
+func (h *Health) droneDown() bool {
+	return h.droneErrorAt.After(h.droneSuccessAt) && h.now().Sub(h.droneSuccessAt) > droneDownLimit
+}
+
+// Liveness fails only when restarting the process may help.
+func (h *Health) Liveness() HealthReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return newHealthReport(map[string]HealthCheck{
+		"slack": h.slackCheck(h.slackDown() <= slackDownLimit),
+	})
+}
+
+// Readiness fails when requests can't be handled because dependencies are down.
+func (h *Health) Readiness() HealthReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return newHealthReport(map[string]HealthCheck{
+		"slack": h.slackCheck(h.slackDown() == 0),
+		"drone": HealthCheck{
+			OK: !h.droneDown(),
+			Detail: map[string]interface{}{
+				"last_success": timeOrNil(h.droneSuccessAt),
+				"last_error":   timeOrNil(h.droneErrorAt),
+				"error":        h.droneError,
+			},
+		},
+		"scheduler": h.schedulerCheck(),
+		// The previous config is kept when reloading fails.
+		"config": HealthCheck{
+			OK: true,
+			Detail: map[string]interface{}{
+				"loaded_at": h.configLoadedAt,
+				"error":     h.configError,
+			},
+		},
+	})
+}
+
+// schedulerCheck fails if the leader doesn't run schedules. h.mu must be held.
+func (h *Health) schedulerCheck() HealthCheck {
+	if h.scheduler == nil {
+		return HealthCheck{OK: true, Detail: map[string]interface{}{}}
+	}
+	running := h.scheduler.Running()
+	return HealthCheck{
+		OK: running == h.leader,
+		Detail: map[string]interface{}{
+			"running":   running,
+			"schedules": len(h.scheduler.List()),
+		},
+	}
+}
+
+// slackCheck h.mu must be held.
+func (h *Health) slackCheck(ok bool) HealthCheck {
+	return HealthCheck{
+		OK: ok,
+		Detail: map[string]interface{}{
+			"leader":     h.leader,
+			"connected":  h.slackConnected,
+			"changed_at": h.slackChangedAt,
+			"error":      h.slackError,
+		},
+	}
+}
+
+func newHealthReport(checks map[string]HealthCheck) HealthReport {
+	status := "OK"
+	for _, c := range checks {
+		if !c.OK {
+			status = "NG"
+		}
+	}
+	return HealthReport{Status: status, Checks: checks}
+}
+
+func timeOrNil(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// healthHandler responds a report. The status code is 503 if any check fails.
+func healthHandler(report func() HealthReport) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res := report()
+		buf, err := json.Marshal(res)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-type", "application/json")
+		if res.Status != "OK" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+		w.Write(buf)
+	}
+}
@@ -0,0 +1,86 @@
+// Package kube is a minimal client of the Kubernetes API for the pod's service account.
+package kube
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Client sends requests to the API server in the cluster.
+type Client struct {
+	// Namespace is the namespace of the pod unless specified.
+	Namespace string
+
+	host      string
+	tokenFile string
+	client    *http.Client
+}
+
+// NewInClusterClient returns Client using the service account of the pod.
+// The namespace of the pod is used if namespace is empty.
+func NewInClusterClient(namespace string) (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in kubernetes cluster")
+	}
+	if namespace == "" {
+		buf, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(buf))
+	}
+
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("invalid service account ca.crt")
+	}
+
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+	return NewClient("https://"+net.JoinHostPort(host, port), namespace, serviceAccountDir+"/token", client), nil
+}
+
+// NewClient returns Client sending requests to host with the token in tokenFile.
+func NewClient(host, namespace, tokenFile string, client *http.Client) *Client {
+	return &Client{Namespace: namespace, host: host, tokenFile: tokenFile, client: client}
+}
+
+// Do sends body encoded in JSON to path.
+func (c *Client) Do(method, path string, body interface{}) (*http.Response, error) {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, c.host+path, &buf)
+	if err != nil {
+		return nil, err
+	}
+	// The token is read every time because projected tokens are rotated.
+	token, err := ioutil.ReadFile(c.tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Content-type", "application/json")
+	return c.client.Do(req)
+}
@@ -0,0 +1,67 @@
+package leader
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// FileLock is a Lock using flock(2) on a file shared between replicas.
+// The lock is held while the process keeps the file open.
+type FileLock struct {
+	Path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func (l *FileLock) Acquire(id string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		return true, nil
+	}
+
+	f, err := os.OpenFile(l.Path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return false, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := f.Truncate(0); err == nil {
+		f.WriteString(id)
+	}
+	l.file = f
+	return true, nil
+}
+
+// Holder reads the id written by the holder.
+func (l *FileLock) Holder() (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	buf, err := ioutil.ReadFile(l.Path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(buf)), err
+}
+
+func (l *FileLock) Release(id string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	l.file.Truncate(0)
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,110 @@
+// Package leader elects one replica which runs singleton work such as
+// scheduled jobs and Slack RTM connection.
+package leader
+
+import (
+	"sync"
+	"time"
+)
+
+// Lock is a lock shared between replicas.
+type Lock interface {
+	// Acquire takes or renews the lock for id.
+	// It returns false if another holder has the lock.
+	Acquire(id string) (bool, error)
+	// Release gives up the lock held by id.
+	Release(id string) error
+	// Holder returns the id of the current holder. Empty if nobody holds the lock.
+	Holder() (string, error)
+}
+
+// Elector keeps trying to become the leader.
+type Elector struct {
+	Lock Lock
+	ID   string
+	// RetryPeriod is the interval of acquiring and renewing the lock.
+	RetryPeriod time.Duration
+	// OnError is called when the lock returns error.
+	OnError func(err error)
+
+	mu     sync.Mutex
+	holder string
+}
+
+// Leader returns the id of the leader last seen and whether it is this replica.
+func (e *Elector) Leader() (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.holder, e.holder == e.ID
+}
+
+// observe records the holder after an election.
+func (e *Elector) observe(ok bool) {
+	holder := e.ID
+	if !ok {
+		var err error
+		if holder, err = e.Lock.Holder(); err != nil {
+			holder = ""
+			if e.OnError != nil {
+				e.OnError(err)
+			}
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.holder = holder
+}
+
+// Run calls lead when this replica becomes the leader.
+// The channel passed to lead is closed when the leadership is lost,
+// and lead is called again on the next election.
+// Run returns after stop is closed, lead returns and the lock is released.
+func (e *Elector) Run(stop <-chan struct{}, lead func(lost <-chan struct{})) {
+	var lost, done chan struct{}
+	ticker := time.NewTicker(e.RetryPeriod)
+	defer ticker.Stop()
+
+	for {
+		ok, err := e.Lock.Acquire(e.ID)
+		if err != nil && e.OnError != nil {
+			e.OnError(err)
+		}
+		e.observe(ok)
+		switch {
+		case ok && lost == nil:
+			lost, done = make(chan struct{}), make(chan struct{})
+			go func(lost, done chan struct{}) {
+				defer close(done)
+				lead(lost)
+			}(lost, done)
+		case !ok && lost != nil:
+			close(lost)
+			lost = nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			e.mu.Lock()
+			e.holder = ""
+			e.mu.Unlock()
+			if lost != nil {
+				close(lost)
+				<-done
+				if err := e.Lock.Release(e.ID); err != nil && e.OnError != nil {
+					e.OnError(err)
+				}
+			}
+			return
+		}
+	}
+}
+
+// Always is a Lock always held. It is used when leader election is disabled.
+type Always struct{}
+
+func (Always) Acquire(id string) (bool, error) { return true, nil }
+func (Always) Release(id string) error         { return nil }
+
+// Holder is unknown but Acquire always succeeds, so the elector always sees itself.
+func (Always) Holder() (string, error) { return "", nil }
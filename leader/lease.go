@@ -0,0 +1,168 @@
+package leader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/vivitInc/maguro/kube"
+)
+
+// microTimeFormat is the format of metav1.MicroTime.
+const microTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// LeaseLock is a Lock using Kubernetes coordination.k8s.io/v1 Lease.
+// The service account needs get, create and update on leases.
+type LeaseLock struct {
+	Namespace string
+	Name      string
+	// Duration is how long the lease is valid without renewal.
+	Duration time.Duration
+
+	kube *kube.Client
+}
+
+type lease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   leaseMetadata `json:"metadata"`
+	Spec       leaseSpec     `json:"spec"`
+}
+
+type leaseMetadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions"`
+}
+
+// NewInClusterLeaseLock returns LeaseLock using the service account of the pod.
+// The namespace of the pod is used if namespace is empty.
+func NewInClusterLeaseLock(namespace, name string, duration time.Duration) (*LeaseLock, error) {
+	client, err := kube.NewInClusterClient(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return &LeaseLock{Namespace: client.Namespace, Name: name, Duration: duration, kube: client}, nil
+}
+
+func (l *LeaseLock) Acquire(id string) (bool, error) {
+	now := time.Now()
+	current, err := l.get()
+	if err != nil {
+		return false, err
+	}
+
+	if current == nil {
+		created := &lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   leaseMetadata{Name: l.Name, Namespace: l.Namespace},
+			Spec: leaseSpec{
+				HolderIdentity:       id,
+				LeaseDurationSeconds: int(l.Duration / time.Second),
+				AcquireTime:          now.Format(microTimeFormat),
+				RenewTime:            now.Format(microTimeFormat),
+			},
+		}
+		return l.write(http.MethodPost, l.path(""), created)
+	}
+
+	spec := &current.Spec
+	if spec.HolderIdentity != id && spec.HolderIdentity != "" {
+		renewed, err := time.Parse(microTimeFormat, spec.RenewTime)
+		if err == nil && renewed.Add(time.Duration(spec.LeaseDurationSeconds)*time.Second).After(now) {
+			return false, nil
+		}
+	}
+	if spec.HolderIdentity != id {
+		spec.HolderIdentity = id
+		spec.AcquireTime = now.Format(microTimeFormat)
+		spec.LeaseTransitions++
+	}
+	spec.LeaseDurationSeconds = int(l.Duration / time.Second)
+	spec.RenewTime = now.Format(microTimeFormat)
+	return l.write(http.MethodPut, l.path(l.Name), current)
+}
+
+// Holder returns the holder of the lease unless it has expired.
+func (l *LeaseLock) Holder() (string, error) {
+	current, err := l.get()
+	if err != nil || current == nil {
+		return "", err
+	}
+	renewed, err := time.Parse(microTimeFormat, current.Spec.RenewTime)
+	if err != nil || renewed.Add(time.Duration(current.Spec.LeaseDurationSeconds)*time.Second).Before(time.Now()) {
+		return "", nil
+	}
+	return current.Spec.HolderIdentity, nil
+}
+
+func (l *LeaseLock) Release(id string) error {
+	current, err := l.get()
+	if err != nil || current == nil || current.Spec.HolderIdentity != id {
+		return err
+	}
+	// Let other replicas take over immediately.
+	current.Spec.HolderIdentity = ""
+	current.Spec.LeaseDurationSeconds = 1
+	_, err = l.write(http.MethodPut, l.path(l.Name), current)
+	return err
+}
+
+func (l *LeaseLock) path(name string) string {
+	path := fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", l.Namespace)
+	if name != "" {
+		path += "/" + name
+	}
+	return path
+}
+
+// get returns nil if the lease doesn't exist.
+func (l *LeaseLock) get() (*lease, error) {
+	res, err := l.kube.Do(http.MethodGet, l.path(l.Name), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		var current lease
+		if err := json.NewDecoder(res.Body).Decode(&current); err != nil {
+			return nil, err
+		}
+		return &current, nil
+	case http.StatusNotFound:
+		return nil, nil
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	return nil, fmt.Errorf("lease: GET %s: %d %s", l.Name, res.StatusCode, body)
+}
+
+// write returns false if another replica updated the lease first.
+func (l *LeaseLock) write(method, path string, body *lease) (bool, error) {
+	res, err := l.kube.Do(method, path, body)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	}
+	buf, _ := ioutil.ReadAll(res.Body)
+	return false, fmt.Errorf("lease: %s %s: %d %s", method, l.Name, res.StatusCode, buf)
+}
@@ -1,15 +1,25 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/kelseyhightower/envconfig"
 	"github.com/nlopes/slack"
-	"github.com/robfig/cron"
 	"github.com/vivitInc/maguro/config"
 	"github.com/vivitInc/maguro/drone"
+	"github.com/vivitInc/maguro/leader"
+	"github.com/vivitInc/maguro/metrics"
+	"github.com/vivitInc/maguro/statestore"
 	"go.uber.org/zap"
 )
 
@@ -19,9 +29,43 @@ type envConfig struct {
 	VerificationToken string `envconfig:"VERIFICATION_TOKEN" required:"true"`
 	BotID             string `envconfig:"BOT_ID" required:"true"`
 	ChannelID         string `envconfig:"CHANNEL_ID" required:"true"`
-	DroneToken        string `envconfig:"DRONE_TOKEN" required:"true"`
-	DroneHost         string `envconfig:"DRONE_HOST" required:"true"`
-	RepositoryOwner   string `envconfig:"REPOSITORY_OWNER" required:"true"`
+	// DRONE_HOST and DRONE_TOKEN are registered as the default drone server.
+	// They can be omitted if drone servers are declared in config.yaml.
+	DroneToken string `envconfig:"DRONE_TOKEN"`
+	DroneHost  string `envconfig:"DRONE_HOST"`
+	// DRONE_VERSION is 0.8 or 1. Detected from the server if empty.
+	DroneVersion string `envconfig:"DRONE_VERSION"`
+	// CONFIG_PATH is the path of config.yaml. -config flag overrides it.
+	ConfigPath string `envconfig:"CONFIG_PATH" default:"./config.yaml"`
+	// CONFIG_RELOAD_INTERVAL is the interval of checking changes of the config file.
+	// The config is reloaded on SIGHUP as well. Disabled if 0.
+	ConfigReloadInterval time.Duration `envconfig:"CONFIG_RELOAD_INTERVAL" default:"10s"`
+	// DRONE_WEBHOOK_SECRET is the secret of drone global webhook (DRONE_WEBHOOK_SECRET of drone server).
+	// /maguro/drone/webhook is enabled if set, and deploy watchers wait for webhooks instead of polling.
+	DroneWebhookSecret string `envconfig:"DRONE_WEBHOOK_SECRET"`
+	// SHUTDOWN_TIMEOUT is how long shutdown waits for running deploy watchers.
+	ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"50s"`
+	// STATE_STORE is dir or configmap (Kubernetes ConfigMap) where state surviving restarts is saved.
+	// The leader takes over deploys and schedules from the state, so replicas must share it.
+	StateStore string `envconfig:"STATE_STORE" default:"dir"`
+	// STATE_DIR is the directory of dir. Use a volume shared by replicas to keep it on pod replacement.
+	StateDir string `envconfig:"STATE_DIR" default:"./state"`
+	// STATE_CONFIGMAP is the name of the ConfigMap of configmap in the namespace of the pod.
+	StateConfigMap string `envconfig:"STATE_CONFIGMAP" default:"maguro-state"`
+	// LEADER_ELECTION is lease (Kubernetes Lease) or file. Disabled if empty.
+	// Only the leader runs schedules and listens slack events.
+	LeaderElection          string `envconfig:"LEADER_ELECTION"`
+	LeaderElectionName      string `envconfig:"LEADER_ELECTION_NAME" default:"maguro"`
+	LeaderElectionNamespace string `envconfig:"LEADER_ELECTION_NAMESPACE"`
+	// LEADER_ELECTION_FILE must be on a volume shared by all replicas (not emptyDir),
+	// otherwise every replica becomes the leader.
+	LeaderElectionFile string `envconfig:"LEADER_ELECTION_FILE" default:"./state/leader.lock"`
+	PodName            string `envconfig:"POD_NAME"`
+	// POD_IP is the address where followers forward interactions to the leader.
+	PodIP string `envconfig:"POD_IP"`
+	// FORWARD_SECRET is shared by all replicas to sign requests forwarded to the leader.
+	// Required if POD_IP is set with leader election.
+	ForwardSecret string `envconfig:"FORWARD_SECRET"`
 }
 
 var logger *zap.Logger
@@ -31,6 +75,10 @@ func main() {
 }
 
 func _main(args []string) int {
+	if len(args) > 0 && args[0] == "validate-config" {
+		return validateConfig(args[1:])
+	}
+
 	if err := initLogger(); err != nil {
 		fmt.Printf("Failed to initialize logger %s", err)
 		return 1
@@ -42,65 +90,275 @@ func _main(args []string) int {
 		return 1
 	}
 
-	conf, err := config.LoadConfig()
+	flags := flag.NewFlagSet("maguro", flag.ContinueOnError)
+	configPath := flags.String("config", env.ConfigPath, "path of config.yaml")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	conf, err := config.LoadConfig(*configPath)
 	if err != nil {
 		logger.Error("Failed to load config", zap.String("detail", err.Error()))
 		return 1
 	}
+	if conf.PublicURL == "" {
+		logger.Warn("public_url is not configured. Images will not be displayed")
+	}
 
-	d := drone.NewDrone(
-		env.DroneHost,
-		env.DroneToken,
-		env.RepositoryOwner,
-	)
+	health := NewHealth()
+	d, err := initDrones(env, conf, health)
+	if err != nil {
+		logger.Error("Failed to initialize drone", zap.String("detail", err.Error()))
+		return 1
+	}
 	client := slack.New(env.BotToken)
+	api := instrumentedSlack{client}
+
+	store := config.NewStore(conf)
+	events := NewBuildEvents(env.DroneWebhookSecret != "")
+	users := NewUserDirectory(store, client, env.BotToken)
+	users.Refresh()
+	st, err := initStateStore(env)
+	if err != nil {
+		logger.Error("Failed to initialize state store", zap.String("detail", err.Error()))
+		return 1
+	}
+	watcher, err := NewDeployWatcher(st)
+	if err != nil {
+		logger.Error("Failed to load deploy watches", zap.String("detail", err.Error()))
+		return 1
+	}
+	queue, err := NewDeployQueue(st, watcher.List())
+	if err != nil {
+		logger.Error("Failed to load queued deploys", zap.String("detail", err.Error()))
+		return 1
+	}
+	var deploys *DeployScheduler
+	deploys, err = NewDeployScheduler(st, func(sd ScheduledDeploy) {
+		deploy := &Deploy{slack: api, drone: d, config: store, deploys: deploys, watcher: watcher, events: events, users: users, queue: queue}
+		deploy.RunScheduled(sd)
+	})
+	if err != nil {
+		logger.Error("Failed to load scheduled deploys", zap.String("detail", err.Error()))
+		return 1
+	}
+
+	// Deploys by schedules wait for the running deploy of the env as well.
+	deploy := &Deploy{slack: api, drone: d, config: store, deploys: deploys, watcher: watcher, events: events, users: users, queue: queue}
+	scheduler, err := InitScheduler(d, api, deploy.RunSchedule, conf, st)
+	if err != nil {
+		logger.Error("Failed to start scheduler", zap.String("detail", err.Error()))
+		return 1
+	}
+
+	monitor, err := NewBuildMonitor(d, api, store, events, users, st)
+	if err != nil {
+		logger.Error("Failed to load build states", zap.String("detail", err.Error()))
+		return 1
+	}
+
+	reloader := &configReloader{
+		path:      *configPath,
+		env:       env,
+		store:     store,
+		drone:     d,
+		scheduler: scheduler,
+		health:    health,
+	}
+	go reloader.Watch(env.ConfigReloadInterval)
+
 	slackListener := &SlackListener{
 		client:    client,
+		api:       api,
 		botID:     env.BotID,
 		channelID: env.ChannelID,
 		drone:     d,
-		config:    conf,
+		config:    store,
+		scheduler: scheduler,
+		deploys:   deploys,
+		watcher:   watcher,
+		queue:     queue,
+		events:    events,
+		users:     users,
+		health:    health,
 	}
 
-	http.Handle("/maguro/interaction", interactionHandler{
-		slack:             client,
+	lock, err := initLeaderLock(env)
+	if err != nil {
+		logger.Error("Failed to initialize leader election", zap.String("detail", err.Error()))
+		return 1
+	}
+	if env.LeaderElection != "" && env.PodIP != "" && env.ForwardSecret == "" {
+		logger.Error("Failed to initialize leader election", zap.String("detail", "FORWARD_SECRET is required to forward requests to the leader"))
+		return 1
+	}
+	elector := &leader.Elector{
+		Lock:        lock,
+		ID:          leaderID(env),
+		RetryPeriod: leaderRetryPeriod,
+		OnError: func(err error) {
+			logger.Error("Failed to elect leader", zap.String("detail", err.Error()))
+		},
+	}
+	// Followers forward interactions to the leader which holds state of deploys.
+	http.Handle("/maguro/interaction", leaderOnly{elector: elector, secret: env.ForwardSecret, handler: interactionHandler{
+		slack:             api,
 		verificationToken: env.VerificationToken,
 		drone:             d,
-		config:            conf,
-	})
-	http.HandleFunc("/maguro/healthz", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("{\"status\": \"OK\"}"))
-	})
+		config:            store,
+		deploys:           deploys,
+		watcher:           watcher,
+		queue:             queue,
+		events:            events,
+		users:             users,
+	}})
+	if env.DroneWebhookSecret != "" {
+		// Build events are delivered in memory to deploy watchers and the monitor running in the leader.
+		http.Handle("/maguro/drone/webhook", leaderOnly{
+			elector: elector,
+			secret:  env.ForwardSecret,
+			handler: webhookHandler{secret: env.DroneWebhookSecret, events: events},
+		})
+	}
+	http.Handle("/metrics", metrics.Handler())
+	health.scheduler = scheduler
+	http.HandleFunc("/maguro/healthz", healthHandler(health.Liveness))
+	http.HandleFunc("/maguro/livez", healthHandler(health.Liveness))
+	http.HandleFunc("/maguro/readyz", healthHandler(health.Readiness))
 	// Slack slash commmands
 	http.Handle("/maguro/public/", http.StripPrefix("/maguro/public/", http.FileServer(http.Dir("./public"))))
 	http.HandleFunc("/maguro/toyama", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("{\"attachments\": [{\"title\": \"toyama\", \"image_url\": \"https://bot.dev.hinata.me/maguro/public/toyama.jpg\"}], \"response_type\": \"in_channel\"}"))
+		w.Write([]byte(fmt.Sprintf("{\"attachments\": [{\"title\": \"toyama\", \"image_url\": \"%s\"}], \"response_type\": \"in_channel\"}", store.Get().AssetURL("toyama.jpg"))))
 	})
 	http.HandleFunc("/maguro/loading", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("{\"attachments\": [{\"title\": \"loading\", \"image_url\": \"https://bot.dev.hinata.me/maguro/public/loading.jpg\"}], \"response_type\": \"in_channel\"}"))
+		w.Write([]byte(fmt.Sprintf("{\"attachments\": [{\"title\": \"loading\", \"image_url\": \"%s\"}], \"response_type\": \"in_channel\"}", store.Get().AssetURL("loading.jpg"))))
 	})
 
-	logger.Info("Start scheduler")
-	InitScheduler(d, &conf.Schedules)
+	lead := func(lost <-chan struct{}) {
+		logger.Info("Became leader", zap.String("id", elector.ID))
+		health.SetLeader(true)
+		// Take over the state saved by the last leader or the last process.
+		loads := []func() error{
+			watcher.Load,
+			func() error { return queue.Load(watcher.List()) },
+			deploys.Load,
+			scheduler.Load,
+			monitor.Load,
+		}
+		for _, load := range loads {
+			if err := load(); err != nil {
+				logger.Error("Failed to load state", zap.String("detail", err.Error()))
+			}
+		}
+		// Deploys running at the last shutdown are watched again.
+		watcher.Resume(deploy.notice)
+		// Queued deploys whose running deploy was lost start now.
+		ready, err := queue.Ready()
+		if err != nil {
+			logger.Error("Failed to save queued deploys", zap.String("detail", err.Error()))
+		}
+		for _, qd := range ready {
+			go deploy.runQueued(qd)
+		}
+		logger.Info("Start scheduler")
+		scheduler.Start()
+		deploys.Start()
+		monitor.Start()
+		logger.Info("Start slack event listening")
+		listening := make(chan struct{})
+		go func() {
+			slackListener.ListenAndResponse(lost)
+			close(listening)
+		}()
+
+		<-lost
+		logger.Info("Lost leadership", zap.String("id", elector.ID))
+		health.SetLeader(false)
+		scheduler.Stop()
+		deploys.Stop()
+		monitor.Stop()
+		if env.LeaderElection != "" {
+			// The next leader resumes the watches. Without leader election they are waited on shutdown.
+			watcher.Stop()
+		}
+		<-listening
+	}
+	// elected is closed after the leader stops schedules and slack listening.
+	stop, elected := make(chan struct{}), make(chan struct{})
+	go func() {
+		elector.Run(stop, lead)
+		close(elected)
+	}()
 
-	logger.Info("Start slack event listening")
-	go slackListener.ListenAndResponse()
+	go health.ProbeDrone(d, stop)
+
+	server := &http.Server{Addr: ":" + env.Port}
+	shutdown := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		s := <-sig
+		logger.Info("Shutting down", zap.String("signal", s.String()))
+		watcher.BeginShutdown()
+
+		ctx, cancel := context.WithTimeout(context.Background(), env.ShutdownTimeout)
+		defer cancel()
+		// Stop accepting requests first so that no new deploy starts.
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Error("Failed to shutdown server", zap.String("detail", err.Error()))
+		}
+		close(stop)
+		<-elected
+		if err := watcher.Shutdown(ctx); err != nil {
+			logger.Warn("Deploy watchers were interrupted", zap.String("detail", err.Error()))
+		}
+		close(shutdown)
+	}()
 
 	logger.Info("Server listening", zap.String("port", env.Port))
-	if err := http.ListenAndServe(":"+env.Port, nil); err != nil {
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		logger.Error("Any error raised", zap.String("detail", err.Error()))
 		return 1
 	}
+	<-shutdown
+	logger.Info("Shutdown completed")
 
 	return 0
 }
 
+// validateConfig checks config files and exits non-zero if any of them is invalid.
+// Usage: maguro validate-config [-config path] [path...]
+func validateConfig(args []string) int {
+	flags := flag.NewFlagSet("validate-config", flag.ContinueOnError)
+	configPath := flags.String("config", "./config.yaml", "path of config.yaml")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{*configPath}
+	}
+
+	code := 0
+	for _, path := range paths {
+		buf, err := ioutil.ReadFile(path)
+		if err == nil {
+			_, err = config.ParseConfig(buf)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: invalid config\n%s\n", path, err)
+			code = 1
+			continue
+		}
+		fmt.Printf("%s: ok\n", path)
+	}
+	return code
+}
+
 func initLogger() error {
 	var err error
 	logger, err = zap.NewProduction()
@@ -119,14 +377,106 @@ func initEnvConfig() (*envConfig, error) {
 	return &env, nil
 }
 
-func InitScheduler(client *drone.Drone, schedules *[]config.Schedule) {
-	cron := cron.New()
-	for _, s := range *schedules {
-		logger.Info("Register function", zap.String("repo", s.Name), zap.String("cron", s.Cron))
-		repo := drone.GetRepoFromFullName(s.Name)
-		cron.AddFunc(s.Cron, func() {
-			client.RestartSucceededMasterBuild(*repo)
-		})
+// initStateStore returns the store of state shared by replicas.
+func initStateStore(env *envConfig) (statestore.Store, error) {
+	switch env.StateStore {
+	case "dir":
+		return statestore.Dir(env.StateDir), nil
+	case "configmap":
+		return statestore.NewInClusterConfigMap("", env.StateConfigMap)
+	}
+	return nil, fmt.Errorf("unknown state store %s", env.StateStore)
+}
+
+// initLeaderLock returns the lock for leader election.
+func initLeaderLock(env *envConfig) (leader.Lock, error) {
+	switch env.LeaderElection {
+	case "":
+		return leader.Always{}, nil
+	case "lease":
+		return leader.NewInClusterLeaseLock(env.LeaderElectionNamespace, env.LeaderElectionName, leaderLeaseDuration)
+	case "file":
+		return &leader.FileLock{Path: env.LeaderElectionFile}, nil
+	}
+	return nil, fmt.Errorf("unknown leader election %s", env.LeaderElection)
+}
+
+func leaderID(env *envConfig) string {
+	name := env.PodName
+	if name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = fmt.Sprintf("maguro-%d", os.Getpid())
+		}
+		name = hostname
+	}
+	if env.PodIP != "" {
+		// Followers forward requests to the address in the ID. See leaderAddr.
+		return fmt.Sprintf("%s@%s:%s", name, env.PodIP, env.Port)
+	}
+	return name
+}
+
+// initDrones registers drone servers and binds repositories to them.
+func initDrones(env *envConfig, conf *config.Config, health *Health) (*drone.Servers, error) {
+	servers := drone.NewServers()
+	if env.DroneHost != "" {
+		servers.Add(defaultDroneServer, instrumentedDrone{defaultDroneServer, drone.NewDrone(env.DroneHost, env.DroneToken, env.DroneVersion), health})
+	}
+	for _, s := range conf.Drones {
+		servers.Add(s.Name, instrumentedDrone{s.Name, drone.NewDrone(s.Host, s.Token, s.Version), health})
+	}
+	if len(servers.Names()) == 0 {
+		return nil, errors.New("no drone server. Set DRONE_HOST or drones in config.yaml")
+	}
+
+	setDefaultBuildURL(env, conf)
+	bindings, err := repoBindings(servers, conf)
+	if err != nil {
+		return nil, err
+	}
+	for name, server := range bindings {
+		servers.Bind(name, server)
+	}
+	return servers, nil
+}
+
+// setDefaultBuildURL uses the build page of the first drone server if build_url is empty.
+func setDefaultBuildURL(env *envConfig, conf *config.Config) {
+	if conf.BuildURL != "" {
+		return
+	}
+	if env.DroneHost != "" {
+		conf.BuildURL = strings.TrimSuffix(env.DroneHost, "/") + "/{repo}/{number}"
+		return
+	}
+	if len(conf.Drones) > 0 {
+		conf.BuildURL = strings.TrimSuffix(conf.Drones[0].Host, "/") + "/{repo}/{number}"
+	}
+}
+
+// repoBindings returns drone servers of repositories declared in config.
+func repoBindings(servers *drone.Servers, conf *config.Config) (map[string]string, error) {
+	bindings := map[string]string{}
+	bind := func(name, server string) error {
+		if server == "" {
+			return nil
+		}
+		if _, ok := servers.Get(server); !ok {
+			return fmt.Errorf("%s: unknown drone server %s", name, server)
+		}
+		bindings[name] = server
+		return nil
+	}
+	for _, r := range conf.Repositories {
+		if err := bind(r.Name, r.Drone); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range conf.Schedules {
+		if err := bind(s.Repo, s.Drone); err != nil {
+			return nil, err
+		}
 	}
-	cron.Start()
+	return bindings, nil
 }
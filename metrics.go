@@ -0,0 +1,229 @@
+package main
+
+import (
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/vivitInc/maguro/drone"
+	"github.com/vivitInc/maguro/metrics"
+)
+
+var (
+	commandsTotal = metrics.NewCounterVec(
+		"maguro_commands_total",
+		"Commands received from Slack.",
+		"command",
+	)
+	interactionsTotal = metrics.NewCounterVec(
+		"maguro_interactions_total",
+		"Interactive message actions received from Slack.",
+		"action",
+	)
+	deploysTotal = metrics.NewCounterVec(
+		"maguro_deploys_total",
+		"Deploys by outcome. outcome is started, success, failure or error.",
+		"repo", "env", "outcome",
+	)
+	deployDuration = metrics.NewHistogramVec(
+		"maguro_deploy_duration_seconds",
+		"Duration of finished deploy builds.",
+		nil,
+		"repo", "env",
+	)
+	droneRequestDuration = metrics.NewHistogramVec(
+		"maguro_drone_request_duration_seconds",
+		"Latency of drone API calls.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		"server", "method",
+	)
+	droneErrorsTotal = metrics.NewCounterVec(
+		"maguro_drone_errors_total",
+		"Failed drone API calls.",
+		"server", "method",
+	)
+	slackErrorsTotal = metrics.NewCounterVec(
+		"maguro_slack_errors_total",
+		"Failed Slack API calls.",
+		"method",
+	)
+	githubErrorsTotal = metrics.NewCounterVec(
+		"maguro_github_errors_total",
+		"Failed GitHub API calls.",
+		"method",
+	)
+	webhooksTotal = metrics.NewCounterVec(
+		"maguro_drone_webhooks_total",
+		"Drone webhooks received.",
+		"event", "action",
+	)
+	scheduleRunsTotal = metrics.NewCounterVec(
+		"maguro_schedule_runs_total",
+		"Scheduled job runs by outcome. outcome is success or error.",
+		"name", "outcome",
+	)
+)
+
+// outcome returns the outcome label of err.
+func outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// observeDeploy records the finished deploy build.
+func observeDeploy(repo, env string, build *drone.Build) {
+	deploysTotal.Inc(repo, env, build.Status)
+	if d := build.Duration(); d > 0 {
+		deployDuration.Observe(d.Seconds(), repo, env)
+	}
+}
+
+// instrumentedSlack counts errors of Slack API calls.
+type instrumentedSlack struct {
+	slackClient
+}
+
+func (s instrumentedSlack) PostMessage(channel, text string, params slack.PostMessageParameters) (string, string, error) {
+	ch, ts, err := s.slackClient.PostMessage(channel, text, params)
+	if err != nil {
+		slackErrorsTotal.Inc("chat.postMessage")
+	}
+	return ch, ts, err
+}
+
+// instrumentedDrone measures latency and errors of drone API calls.
+// Results are reported to health as well.
+type instrumentedDrone struct {
+	name   string
+	client drone.Client
+	health *Health
+}
+
+var _ drone.Client = instrumentedDrone{}
+
+func (d instrumentedDrone) observe(method string, start time.Time, err error) {
+	droneRequestDuration.Observe(time.Since(start).Seconds(), d.name, method)
+	// No build is a normal answer of the API.
+	if err == drone.ErrBuildNotFound {
+		err = nil
+	}
+	if err != nil {
+		droneErrorsTotal.Inc(d.name, method)
+	}
+	if d.health != nil {
+		d.health.DroneCalled(err)
+	}
+}
+
+func (d instrumentedDrone) Ping() error {
+	start := time.Now()
+	err := d.client.Ping()
+	d.observe("Ping", start, err)
+	return err
+}
+
+func (d instrumentedDrone) GetRepositories(owners []string) ([]drone.Repo, error) {
+	start := time.Now()
+	v, err := d.client.GetRepositories(owners)
+	d.observe("GetRepositories", start, err)
+	return v, err
+}
+
+func (d instrumentedDrone) GetBuilds(fullName string) ([]*drone.Build, error) {
+	start := time.Now()
+	v, err := d.client.GetBuilds(fullName)
+	d.observe("GetBuilds", start, err)
+	return v, err
+}
+
+func (d instrumentedDrone) GetRunningBuildNumber(fullName string) ([]*drone.Build, error) {
+	start := time.Now()
+	v, err := d.client.GetRunningBuildNumber(fullName)
+	d.observe("GetRunningBuildNumber", start, err)
+	return v, err
+}
+
+func (d instrumentedDrone) GetSucceededBuilds(fullName string) ([]*drone.Build, error) {
+	start := time.Now()
+	v, err := d.client.GetSucceededBuilds(fullName)
+	d.observe("GetSucceededBuilds", start, err)
+	return v, err
+}
+
+func (d instrumentedDrone) GetLatestBuilds(fullName string) ([]*drone.Build, error) {
+	start := time.Now()
+	v, err := d.client.GetLatestBuilds(fullName)
+	d.observe("GetLatestBuilds", start, err)
+	return v, err
+}
+
+func (d instrumentedDrone) GetLatestBuild(fullName, branch string, statuses, events []string) (*drone.Build, error) {
+	start := time.Now()
+	v, err := d.client.GetLatestBuild(fullName, branch, statuses, events)
+	d.observe("GetLatestBuild", start, err)
+	return v, err
+}
+
+func (d instrumentedDrone) GetBuild(fullName string, number int) (*drone.Build, error) {
+	start := time.Now()
+	v, err := d.client.GetBuild(fullName, number)
+	d.observe("GetBuild", start, err)
+	return v, err
+}
+
+func (d instrumentedDrone) GetBuildLogs(fullName string, number, stage, step int) ([]string, error) {
+	start := time.Now()
+	v, err := d.client.GetBuildLogs(fullName, number, stage, step)
+	d.observe("GetBuildLogs", start, err)
+	return v, err
+}
+
+func (d instrumentedDrone) CreateBuild(fullName, branch string, params map[string]string) (*drone.Build, error) {
+	start := time.Now()
+	v, err := d.client.CreateBuild(fullName, branch, params)
+	d.observe("CreateBuild", start, err)
+	return v, err
+}
+
+func (d instrumentedDrone) StartBuild(fullName string, number int) (*drone.Build, error) {
+	start := time.Now()
+	v, err := d.client.StartBuild(fullName, number)
+	d.observe("StartBuild", start, err)
+	return v, err
+}
+
+func (d instrumentedDrone) RestartBuild(fullName string, number int) error {
+	start := time.Now()
+	err := d.client.RestartBuild(fullName, number)
+	d.observe("RestartBuild", start, err)
+	return err
+}
+
+func (d instrumentedDrone) KillBuild(fullName string, number int) error {
+	start := time.Now()
+	err := d.client.KillBuild(fullName, number)
+	d.observe("KillBuild", start, err)
+	return err
+}
+
+func (d instrumentedDrone) Deploy(fullName string, number int, env string, params map[string]string) (*drone.Build, error) {
+	start := time.Now()
+	v, err := d.client.Deploy(fullName, number, env, params)
+	d.observe("Deploy", start, err)
+	return v, err
+}
+
+func (d instrumentedDrone) GetCrons(fullName string) ([]*drone.Cron, error) {
+	start := time.Now()
+	v, err := d.client.GetCrons(fullName)
+	d.observe("GetCrons", start, err)
+	return v, err
+}
+
+func (d instrumentedDrone) ExecCron(fullName, cron string) error {
+	start := time.Now()
+	err := d.client.ExecCron(fullName, cron)
+	d.observe("ExecCron", start, err)
+	return err
+}
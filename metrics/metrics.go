@@ -0,0 +1,216 @@
+// Package metrics exposes counters and histograms in Prometheus text format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are upper bounds of histograms in seconds.
+var DefaultBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 600, 1800}
+
+type collector interface {
+	write(w io.Writer)
+}
+
+// Registry is a set of metrics served together.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// Default is the registry NewCounterVec and NewHistogramVec register to.
+var Default = &Registry{}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	collectors := append([]collector{}, r.collectors...)
+	r.mu.Unlock()
+
+	var buf bytes.Buffer
+	for _, c := range collectors {
+		c.write(&buf)
+	}
+	w.Header().Set("Content-type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// Handler serves metrics of Default.
+func Handler() http.Handler {
+	return Default
+}
+
+// vec holds values per label values.
+type vec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]interface{}
+}
+
+func (v *vec) get(values []string, create func() interface{}) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s needs %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := labelString(v.labels, values)
+	if m, ok := v.values[key]; ok {
+		return m
+	}
+	m := create()
+	v.values[key] = m
+	return m
+}
+
+// keys returns label strings in order. v.mu must be held.
+func (v *vec) keys() []string {
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (v *vec) header(w io.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, typ)
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	vec
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec{name: name, help: help, labels: labels, values: map[string]interface{}{}}}
+	Default.register(c)
+	return c
+}
+
+// Inc adds 1 to the counter of label values.
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) Add(n float64, values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.get(values, func() interface{} { return new(float64) }).(*float64)
+	*p += n
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w, "counter")
+	for _, k := range c.keys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, braces(k), formatFloat(*c.values[k].(*float64)))
+	}
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	vec
+	buckets []float64
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec returns a histogram. DefaultBuckets are used if buckets is nil.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &HistogramVec{
+		vec:     vec{name: name, help: help, labels: labels, values: map[string]interface{}{}},
+		buckets: buckets,
+	}
+	Default.register(h)
+	return h
+}
+
+// Observe records v to the histogram of label values.
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	m := h.get(values, func() interface{} {
+		return &histogram{counts: make([]uint64, len(h.buckets))}
+	}).(*histogram)
+	for i, b := range h.buckets {
+		if v <= b {
+			m.counts[i]++
+		}
+	}
+	m.count++
+	m.sum += v
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w, "histogram")
+	for _, k := range h.keys() {
+		m := h.values[k].(*histogram)
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, braces(join(k, "le", formatFloat(b))), m.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, braces(join(k, "le", "+Inf")), m.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, braces(k), formatFloat(m.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, braces(k), m.count)
+	}
+}
+
+// labelString returns a="x",b="y".
+func labelString(labels, values []string) string {
+	pairs := make([]string, len(labels))
+	for i, l := range labels {
+		pairs[i] = pair(l, values[i])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func pair(label, value string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return fmt.Sprintf(`%s="%s"`, label, r.Replace(value))
+}
+
+func join(labels, label, value string) string {
+	if labels == "" {
+		return pair(label, value)
+	}
+	return labels + "," + pair(label, value)
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/vivitInc/maguro/config"
+	"github.com/vivitInc/maguro/drone"
+	"github.com/vivitInc/maguro/statestore"
+	"go.uber.org/zap"
+)
+
+const (
+	// monitorPollInterval is the interval of polling subscribed branches without webhook.
+	monitorPollInterval = 1 * time.Minute
+	// monitorWebhookPollInterval is the interval of polling to catch up missed webhooks,
+	// e.g. webhooks rejected while the leader changes.
+	monitorWebhookPollInterval = 3 * time.Minute
+)
+
+// branchState is the last finished build of a branch.
+type branchState struct {
+	Number int    `json:"number"`
+	Status string `json:"status"`
+}
+
+// BuildMonitor posts failures and recoveries of subscribed branches.
+type BuildMonitor struct {
+	drone  *drone.Servers
+	client slackClient
+	config *config.Store
+	events *BuildEvents
+	users  *UserDirectory
+
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+	// state is where states are saved
+	state statestore.Store
+	// {repo}@{branch} -> state
+	states map[string]branchState
+}
+
+// NewBuildMonitor restores states of branches from st. They are not saved if st is nil.
+func NewBuildMonitor(servers *drone.Servers, client slackClient, store *config.Store, events *BuildEvents, users *UserDirectory, st statestore.Store) (*BuildMonitor, error) {
+	m := &BuildMonitor{
+		drone:  servers,
+		client: client,
+		config: store,
+		events: events,
+		users:  users,
+		state:  st,
+		states: map[string]branchState{},
+	}
+	if err := m.Load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Load restores states saved by the last leader.
+func (m *BuildMonitor) Load() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state == nil {
+		return nil
+	}
+	buf, err := m.state.Read(buildsState)
+	if err != nil || buf == nil {
+		return err
+	}
+	states := map[string]branchState{}
+	if err := json.Unmarshal(buf, &states); err != nil {
+		return fmt.Errorf("%s: %s", buildsState, err)
+	}
+	m.states = states
+	return nil
+}
+
+// Start starts watching builds by webhooks and polling.
+func (m *BuildMonitor) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stop != nil {
+		return
+	}
+	m.stop, m.done = make(chan struct{}), make(chan struct{})
+	go m.run(m.stop, m.done)
+}
+
+// Stop stops watching builds and waits for it.
+func (m *BuildMonitor) Stop() {
+	m.mu.Lock()
+	stop, done := m.stop, m.done
+	m.stop, m.done = nil, nil
+	m.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+func (m *BuildMonitor) run(stop, done chan struct{}) {
+	defer close(done)
+	events, unsubscribe := m.events.Subscribe("", 0)
+	defer unsubscribe()
+
+	interval := monitorPollInterval
+	if m.events.Enabled() {
+		interval = monitorWebhookPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	m.poll()
+	for {
+		select {
+		case ev := <-events:
+			m.handle(ev.Repo, ev.Build)
+		case <-ticker.C:
+			m.poll()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// poll checks the latest finished build of all subscribed branches.
+func (m *BuildMonitor) poll() {
+	for _, s := range m.config.Get().Subscriptions {
+		for _, branch := range s.Branches {
+			build, err := m.drone.ForRepo(s.Repo).GetLatestBuild(s.Repo, branch, []string{"success", "failure", "error"}, monitoredEvents)
+			if err == drone.ErrBuildNotFound {
+				continue
+			}
+			if err != nil {
+				logger.Error("Failed to get latest build", zap.String("repo", s.Repo), zap.String("branch", branch), zap.String("detail", err.Error()))
+				continue
+			}
+			m.handle(s.Repo, build)
+		}
+	}
+}
+
+// monitoredEvents are events of builds which tell the state of the branch.
+// Only builds of commits pushed to the branch and cron builds do.
+var monitoredEvents = []string{"push", "cron"}
+
+func isMonitoredEvent(event string) bool {
+	for _, e := range monitoredEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// handle posts to subscribed channels if the state of the branch changed by the build.
+func (m *BuildMonitor) handle(repo string, build *drone.Build) {
+	if build.Deploy != "" || !isMonitoredEvent(build.Event) {
+		return
+	}
+	switch build.Status {
+	case "success", "failure", "error":
+	default:
+		return
+	}
+
+	conf := m.config.Get()
+	channels := []string{}
+	for _, s := range conf.Subscriptions {
+		if s.Repo != repo {
+			continue
+		}
+		for _, b := range s.Branches {
+			if b == build.Branch {
+				channels = append(channels, s.Channel)
+				break
+			}
+		}
+	}
+	if len(channels) == 0 {
+		return
+	}
+
+	key := repo + "@" + build.Branch
+	m.mu.Lock()
+	prev, ok := m.states[key]
+	if ok && prev.Number >= build.Number {
+		m.mu.Unlock()
+		return
+	}
+	m.states[key] = branchState{Number: build.Number, Status: build.Status}
+	if err := m.save(); err != nil {
+		logger.Error("Failed to save build states", zap.String("detail", err.Error()))
+	}
+	m.mu.Unlock()
+
+	// The first build seen is not notified because it is not known whether the state changed.
+	if !ok {
+		return
+	}
+	failed := build.Status != "success"
+	if failed == (prev.Status != "success") {
+		return
+	}
+
+	attachments := BuildNotificationAttachments(repo, build, m.users.Mention(build.Author, build.Email), conf)
+	for _, ch := range channels {
+		params := slack.PostMessageParameters{Attachments: attachments}
+		if _, _, err := m.client.PostMessage(ch, "", params); err != nil {
+			logger.Error("Failed to post message", zap.String("detail", err.Error()))
+		}
+	}
+}
+
+// save writes states. m.mu must be held.
+func (m *BuildMonitor) save() error {
+	if m.state == nil {
+		return nil
+	}
+	buf, err := json.MarshalIndent(m.states, "", "  ")
+	if err != nil {
+		return err
+	}
+	return m.state.Write(buildsState, buf)
+}
+
+// BuildNotificationAttachments author is the mention of the commit author.
+func BuildNotificationAttachments(repo string, build *drone.Build, author string, conf *config.Config) []slack.Attachment {
+	text := fmt.Sprintf("%sのビルドが落ちたよ... %s 見てあげて！", build.Branch, author)
+	if build.Status == "success" {
+		text = fmt.Sprintf("%sのビルドが直ったよ！ %s ありがとう！", build.Branch, author)
+	}
+	return []slack.Attachment{
+		slack.Attachment{
+			Title:     fmt.Sprintf("%s #%d", repo, build.Number),
+			TitleLink: conf.BuildLink(repo, build.Number),
+			Text:      text,
+			Fields: []slack.AttachmentField{
+				slack.AttachmentField{
+					Title: "コミット",
+					Value: fmt.Sprintf("%s %s", build.Commit, build.Message),
+					Short: false,
+				},
+				slack.AttachmentField{
+					Title: "ステータス",
+					Value: build.Status,
+					Short: true,
+				},
+			},
+			Color: StatusColor(build.Status),
+		},
+	}
+}
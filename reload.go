@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/vivitInc/maguro/config"
+	"github.com/vivitInc/maguro/drone"
+	"go.uber.org/zap"
+)
+
+// configReloader reloads config.yaml and applies it to running components.
+type configReloader struct {
+	path      string
+	env       *envConfig
+	store     *config.Store
+	drone     *drone.Servers
+	scheduler *Scheduler
+	health    *Health
+
+	mu sync.Mutex
+	// last is the content of the file last loaded.
+	last []byte
+}
+
+// Watch reloads the config on SIGHUP and when the file content changes.
+// The content is compared instead of mtime because a ConfigMap volume
+// updates the file by swapping a symlink.
+func (r *configReloader) Watch(interval time.Duration) {
+	r.mu.Lock()
+	r.last, _ = ioutil.ReadFile(r.path)
+	r.mu.Unlock()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-hup:
+			logger.Info("Reload config by SIGHUP", zap.String("path", r.path))
+			r.reload(true)
+		case <-tick:
+			r.reload(false)
+		}
+	}
+}
+
+// reload applies the config file if it is changed or force is true.
+func (r *configReloader) reload(force bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	buf, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		r.health.ConfigLoaded(err)
+		logger.Error("Failed to read config", zap.String("path", r.path), zap.String("detail", err.Error()))
+		return
+	}
+	if !force && bytes.Equal(buf, r.last) {
+		return
+	}
+	r.last = buf
+
+	err = r.apply()
+	r.health.ConfigLoaded(err)
+	if err != nil {
+		logger.Error("Failed to reload config. Keep the current config", zap.String("path", r.path), zap.String("detail", err.Error()))
+		return
+	}
+	logger.Info("Reloaded config", zap.String("path", r.path))
+}
+
+// apply loads the config and swaps it. Nothing is changed if the new config is invalid.
+func (r *configReloader) apply() error {
+	conf, err := config.LoadConfig(r.path)
+	if err != nil {
+		return err
+	}
+	// Drone clients are created at startup.
+	if !reflect.DeepEqual(conf.Drones, r.store.Get().Drones) {
+		return errors.New("drones can't be changed without restart")
+	}
+	setDefaultBuildURL(r.env, conf)
+	bindings, err := repoBindings(r.drone, conf)
+	if err != nil {
+		return err
+	}
+	if err := r.scheduler.Reload(r.drone, conf); err != nil {
+		return err
+	}
+
+	// Bindings found by listing repositories are kept.
+	for name, server := range bindings {
+		r.drone.Bind(name, server)
+	}
+	r.store.Set(conf)
+	return nil
+}
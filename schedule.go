@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/nlopes/slack"
+	"go.uber.org/zap"
+)
+
+const scheduleTimeFormat = "2006-01-02 15:04 MST"
+
+// Schedule handles schedule command.
+type Schedule struct {
+	slack     slackClient
+	scheduler *Scheduler
+}
+
+func ScheduleAttachmentFields(info ScheduleInfo) []slack.AttachmentField {
+	state := "有効"
+	if info.State.Paused {
+		state = "停止中"
+	}
+	last := "まだ実行してないよ"
+	if !info.State.LastRun.IsZero() {
+		last = info.State.LastRun.In(info.Location).Format(scheduleTimeFormat)
+		switch {
+		case !info.State.LastSuccess:
+			last += fmt.Sprintf(" 失敗: %s", info.State.LastError)
+		case info.State.LastBuild != 0:
+			last += fmt.Sprintf(" 成功: #%d", info.State.LastBuild)
+		default:
+			last += " 成功"
+		}
+	}
+	return []slack.AttachmentField{
+		slack.AttachmentField{
+			Title: "種類",
+			Value: info.Schedule.Type,
+			Short: true,
+		},
+		slack.AttachmentField{
+			Title: "cron",
+			Value: fmt.Sprintf("%s (%s)", info.Schedule.Cron, info.Location),
+			Short: true,
+		},
+		slack.AttachmentField{
+			Title: "状態",
+			Value: state,
+			Short: true,
+		},
+		slack.AttachmentField{
+			Title: "次回",
+			Value: info.Next.In(info.Location).Format(scheduleTimeFormat),
+			Short: true,
+		},
+		slack.AttachmentField{
+			Title: "前回",
+			Value: last,
+			Short: false,
+		},
+	}
+}
+
+// Handle runs schedule sub command.
+// Format: schedule list|pause|resume|run [{name}]
+func (s *Schedule) Handle(event *slack.MessageEvent, args []string) {
+	if len(args) == 0 || args[0] == "list" {
+		s.list(event.Channel)
+		return
+	}
+	if len(args) < 2 {
+		s.post(event.Channel, Message("スケジュールの名前を指定してね！", "danger"))
+		return
+	}
+
+	name := args[1]
+	switch args[0] {
+	case "pause":
+		if err := s.scheduler.Pause(name); err != nil {
+			s.post(event.Channel, Message(fmt.Sprintf("%sを止められなかった...\n%s", name, err), "danger"))
+			return
+		}
+		s.post(event.Channel, Message(fmt.Sprintf("%sを止めたよ！", name), "good"))
+	case "resume":
+		if err := s.scheduler.Resume(name); err != nil {
+			s.post(event.Channel, Message(fmt.Sprintf("%sを再開できなかった...\n%s", name, err), "danger"))
+			return
+		}
+		s.post(event.Channel, Message(fmt.Sprintf("%sを再開したよ！", name), "good"))
+	case "run":
+		build, err := s.scheduler.Run(name)
+		if err != nil {
+			s.post(event.Channel, Message(fmt.Sprintf("%sの実行に失敗したよ...\n%s", name, err), "danger"))
+			return
+		}
+		text := fmt.Sprintf("%sを実行したよ！", name)
+		if build != nil {
+			text = fmt.Sprintf("%sを実行したよ！ #%d", name, build.Number)
+		}
+		s.post(event.Channel, Message(text, "good"))
+	default:
+		s.post(event.Channel, Message("list, pause, resume, runのどれかを指定してね！", "danger"))
+	}
+}
+
+func (s *Schedule) list(channel string) {
+	list := s.scheduler.List()
+	if len(list) == 0 {
+		s.post(channel, Message("スケジュールはないよ！", ""))
+		return
+	}
+
+	attachments := []slack.Attachment{}
+	for _, info := range list {
+		color := "good"
+		if info.State.Paused {
+			color = "warning"
+		}
+		attachments = append(attachments, slack.Attachment{
+			Title:  info.Schedule.Name,
+			Fields: ScheduleAttachmentFields(info),
+			Color:  color,
+		})
+	}
+	s.post(channel, attachments)
+}
+
+func (s *Schedule) post(channel string, attachments []slack.Attachment) {
+	params := slack.PostMessageParameters{
+		Attachments: attachments,
+	}
+	if _, _, err := s.slack.PostMessage(channel, "", params); err != nil {
+		logger.Error("Failed to post message", zap.String("detail", err.Error()))
+	}
+}
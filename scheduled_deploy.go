@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vivitInc/maguro/statestore"
+	"go.uber.org/zap"
+)
+
+// ScheduledDeploy is a deploy reserved to run at the time.
+type ScheduledDeploy struct {
+	ID      string    `json:"id"`
+	Repo    string    `json:"repo"`
+	Env     string    `json:"env"`
+	Number  int       `json:"number"`
+	At      time.Time `json:"at"`
+	Channel string    `json:"channel"`
+	User    string    `json:"user"`
+}
+
+// DeployScheduler keeps scheduled deploys in the state store and runs them on time.
+type DeployScheduler struct {
+	mu      sync.Mutex
+	state   statestore.Store
+	nextID  int
+	deploys map[string]*ScheduledDeploy
+	timers  map[string]*time.Timer
+	running bool
+	run     func(ScheduledDeploy)
+}
+
+// NewDeployScheduler restores scheduled deploys from st. They are not saved if st is nil.
+// run is called on time after Start is called.
+func NewDeployScheduler(st statestore.Store, run func(ScheduledDeploy)) (*DeployScheduler, error) {
+	s := &DeployScheduler{
+		state:   st,
+		nextID:  1,
+		deploys: map[string]*ScheduledDeploy{},
+		timers:  map[string]*time.Timer{},
+		run:     run,
+	}
+	if err := s.Load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Load restores scheduled deploys saved by the last leader. It must be called while stopped.
+func (s *DeployScheduler) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == nil {
+		return nil
+	}
+	buf, err := s.state.Read(deploysState)
+	if err != nil || buf == nil {
+		return err
+	}
+	var list []*ScheduledDeploy
+	if err := json.Unmarshal(buf, &list); err != nil {
+		return fmt.Errorf("%s: %s", deploysState, err)
+	}
+	s.nextID, s.deploys = 1, map[string]*ScheduledDeploy{}
+	for _, d := range list {
+		s.deploys[d.ID] = d
+		if id, err := strconv.Atoi(d.ID); err == nil && id >= s.nextID {
+			s.nextID = id + 1
+		}
+	}
+	return nil
+}
+
+// Add reserves the deploy and returns it with ID.
+func (s *DeployScheduler) Add(d ScheduledDeploy) (ScheduledDeploy, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d.ID = strconv.Itoa(s.nextID)
+	s.nextID++
+	s.deploys[d.ID] = &d
+	if err := s.save(); err != nil {
+		delete(s.deploys, d.ID)
+		return d, err
+	}
+	if s.running {
+		s.arm(&d)
+	}
+	return d, nil
+}
+
+// Cancel removes the scheduled deploy.
+func (s *DeployScheduler) Cancel(id string) (ScheduledDeploy, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.deploys[id]
+	if !ok {
+		return ScheduledDeploy{}, fmt.Errorf("scheduled deploy %s not found", id)
+	}
+	if t, ok := s.timers[id]; ok {
+		t.Stop()
+		delete(s.timers, id)
+	}
+	delete(s.deploys, id)
+	return *d, s.save()
+}
+
+// List returns scheduled deploys in time order.
+func (s *DeployScheduler) List() []ScheduledDeploy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []ScheduledDeploy{}
+	for _, d := range s.deploys {
+		list = append(list, *d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].At.Before(list[j].At) })
+	return list
+}
+
+// Start runs deploys on time. Overdue deploys run immediately.
+func (s *DeployScheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = true
+	for _, d := range s.deploys {
+		s.arm(d)
+	}
+}
+
+// Stop stops running deploys. They are kept and run after next Start.
+func (s *DeployScheduler) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = false
+	for id, t := range s.timers {
+		t.Stop()
+		delete(s.timers, id)
+	}
+}
+
+// arm sets a timer of the deploy. s.mu must be held.
+func (s *DeployScheduler) arm(d *ScheduledDeploy) {
+	id := d.ID
+	s.timers[id] = time.AfterFunc(time.Until(d.At), func() {
+		s.mu.Lock()
+		d, ok := s.deploys[id]
+		if !ok || !s.running {
+			s.mu.Unlock()
+			return
+		}
+		delete(s.deploys, id)
+		delete(s.timers, id)
+		if err := s.save(); err != nil {
+			logger.Error("Failed to save scheduled deploys", zap.String("detail", err.Error()))
+		}
+		s.mu.Unlock()
+
+		logger.Info("Run scheduled deploy", zap.String("id", id), zap.String("repo", d.Repo), zap.String("env", d.Env))
+		s.run(*d)
+	})
+}
+
+// save writes scheduled deploys. s.mu must be held.
+func (s *DeployScheduler) save() error {
+	if s.state == nil {
+		return nil
+	}
+	list := []*ScheduledDeploy{}
+	for _, d := range s.deploys {
+		list = append(list, d)
+	}
+	buf, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.state.Write(deploysState, buf)
+}
+
+// parseDeployTime parses {HH:MM} or {YYYY-MM-DD} {HH:MM} in loc.
+// {HH:MM} means the next time of the day.
+func parseDeployTime(args []string, now time.Time, loc *time.Location) (time.Time, error) {
+	now = now.In(loc)
+	switch len(args) {
+	case 1:
+		t, err := time.ParseInLocation("15:04", args[0], loc)
+		if err != nil {
+			return time.Time{}, err
+		}
+		at := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+		if !at.After(now) {
+			at = at.AddDate(0, 0, 1)
+		}
+		return at, nil
+	case 2:
+		at, err := time.ParseInLocation("2006-01-02 15:04", strings.Join(args, " "), loc)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if !at.After(now) {
+			return time.Time{}, fmt.Errorf("%s is past", at.Format("2006-01-02 15:04"))
+		}
+		return at, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %s", strings.Join(args, " "))
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/robfig/cron"
+	"github.com/vivitInc/maguro/config"
+	"github.com/vivitInc/maguro/drone"
+	"github.com/vivitInc/maguro/statestore"
+	"go.uber.org/zap"
+)
+
+// Scheduler runs schedules in config and keeps their state.
+type Scheduler struct {
+	// now is replaceable for tests.
+	now     func() time.Time
+	mu      sync.Mutex
+	cron    *cron.Cron
+	running bool
+	names   []string
+	entries map[string]*scheduleEntry
+	// state is where paused state and last results are saved
+	state  statestore.Store
+	client slackClient
+	deploy deployFunc
+	config *config.Config
+}
+
+// deployFunc deploys the build of the schedule through the deploy queue.
+// The build is nil if the deploy is queued. *Deploy.RunSchedule implements it.
+type deployFunc func(s config.Schedule, number int) (*drone.Build, error)
+
+type scheduleEntry struct {
+	schedule config.Schedule
+	location *time.Location
+	spec     cron.Schedule
+	job      scheduledJob
+	state    scheduleState
+}
+
+// scheduleState is the persisted state of a schedule.
+type scheduleState struct {
+	Paused      bool      `json:"paused"`
+	LastRun     time.Time `json:"last_run"`
+	LastBuild   int       `json:"last_build"`
+	LastError   string    `json:"last_error"`
+	LastSuccess bool      `json:"last_success"`
+}
+
+// ScheduleInfo is a snapshot of a schedule.
+type ScheduleInfo struct {
+	Schedule config.Schedule
+	Location *time.Location
+	Next     time.Time
+	State    scheduleState
+}
+
+// InitScheduler validates schedules and registers them.
+// State of schedules is restored from st. Schedules run after Start is called.
+func InitScheduler(servers *drone.Servers, client slackClient, deploy deployFunc, conf *config.Config, st statestore.Store) (*Scheduler, error) {
+	sc := &Scheduler{
+		now:     time.Now,
+		cron:    cron.New(),
+		entries: map[string]*scheduleEntry{},
+		state:   st,
+		client:  client,
+		deploy:  deploy,
+	}
+	states, err := sc.load()
+	if err != nil {
+		return nil, err
+	}
+
+	names, entries, err := newScheduleEntries(servers, client, deploy, conf, states)
+	if err != nil {
+		return nil, err
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.apply(conf, names, entries)
+	return sc, nil
+}
+
+// Reload replaces schedules with the ones in conf.
+// State of schedules with the same name is kept.
+// The current schedules are kept if any of new schedules is invalid.
+func (sc *Scheduler) Reload(servers *drone.Servers, conf *config.Config) error {
+	sc.mu.Lock()
+	states := map[string]scheduleState{}
+	for name, e := range sc.entries {
+		states[name] = e.state
+	}
+	sc.mu.Unlock()
+
+	names, entries, err := newScheduleEntries(servers, sc.client, sc.deploy, conf, states)
+	if err != nil {
+		return err
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	// Running jobs of old entries update state of the old entries and it is discarded.
+	sc.cron.Stop()
+	sc.cron = cron.New()
+	sc.apply(conf, names, entries)
+	if sc.running {
+		sc.cron.Start()
+	}
+	return sc.save()
+}
+
+// newScheduleEntries validates schedules in conf and returns them in config order.
+func newScheduleEntries(servers *drone.Servers, client slackClient, deploy deployFunc, conf *config.Config, states map[string]scheduleState) ([]string, map[string]*scheduleEntry, error) {
+	names := []string{}
+	entries := map[string]*scheduleEntry{}
+	for _, s := range conf.Schedules {
+		job, err := newScheduledJob(s, servers, client, deploy, conf)
+		if err != nil {
+			return nil, nil, err
+		}
+		loc, err := scheduleLocation(s, conf)
+		if err != nil {
+			return nil, nil, err
+		}
+		spec, err := cron.Parse(s.Cron)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: invalid cron %s: %s", s.Name, s.Cron, err)
+		}
+		if _, ok := entries[s.Name]; ok {
+			return nil, nil, fmt.Errorf("%s: duplicated schedule name", s.Name)
+		}
+
+		names = append(names, s.Name)
+		entries[s.Name] = &scheduleEntry{
+			schedule: s,
+			location: loc,
+			spec:     zonedSchedule{spec, loc},
+			job:      job,
+			state:    states[s.Name],
+		}
+	}
+	return names, entries, nil
+}
+
+// apply registers entries to cron. sc.mu must be held.
+func (sc *Scheduler) apply(conf *config.Config, names []string, entries map[string]*scheduleEntry) {
+	sc.config = conf
+	sc.names = names
+	sc.entries = entries
+	for _, name := range names {
+		e := entries[name]
+		logger.Info(
+			"Register function",
+			zap.String("name", name),
+			zap.String("type", e.schedule.Type),
+			zap.String("cron", e.schedule.Cron),
+			zap.String("timezone", e.location.String()),
+		)
+
+		name := name
+		sc.cron.Schedule(e.spec, cron.FuncJob(func() {
+			if sc.isPaused(name) {
+				logger.Info("Skip paused schedule", zap.String("name", name))
+				return
+			}
+			sc.Run(name)
+		}))
+	}
+}
+
+// Start starts running schedules.
+func (sc *Scheduler) Start() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.running = true
+	sc.cron.Start()
+}
+
+// Running reports whether schedules are running.
+func (sc *Scheduler) Running() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.running
+}
+
+// Stop stops running schedules. Running jobs are not interrupted.
+func (sc *Scheduler) Stop() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.running = false
+	sc.cron.Stop()
+}
+
+// List returns schedules in config order.
+func (sc *Scheduler) List() []ScheduleInfo {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	now := sc.now()
+	list := []ScheduleInfo{}
+	for _, name := range sc.names {
+		e := sc.entries[name]
+		list = append(list, ScheduleInfo{
+			Schedule: e.schedule,
+			Location: e.location,
+			Next:     e.spec.Next(now),
+			State:    e.state,
+		})
+	}
+	return list
+}
+
+// Pause stops running the schedule until resumed.
+func (sc *Scheduler) Pause(name string) error {
+	return sc.setPaused(name, true)
+}
+
+// Resume restarts running the paused schedule.
+func (sc *Scheduler) Resume(name string) error {
+	return sc.setPaused(name, false)
+}
+
+// Run runs the schedule now regardless of paused state.
+func (sc *Scheduler) Run(name string) (*drone.Build, error) {
+	sc.mu.Lock()
+	e, ok := sc.entries[name]
+	conf := sc.config
+	sc.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("schedule %s not found", name)
+	}
+
+	build, err := runSchedule(e.schedule, e.job, sc.client, conf)
+	scheduleRunsTotal.Inc(name, outcome(err))
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	e.state.LastRun = sc.now()
+	e.state.LastSuccess = err == nil
+	e.state.LastBuild = 0
+	e.state.LastError = ""
+	if build != nil {
+		e.state.LastBuild = build.Number
+	}
+	if err != nil {
+		e.state.LastError = err.Error()
+	}
+	if err := sc.save(); err != nil {
+		logger.Error("Failed to save schedule state", zap.String("detail", err.Error()))
+	}
+	return build, err
+}
+
+func (sc *Scheduler) isPaused(name string) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	e, ok := sc.entries[name]
+	return ok && e.state.Paused
+}
+
+func (sc *Scheduler) setPaused(name string, paused bool) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	e, ok := sc.entries[name]
+	if !ok {
+		return fmt.Errorf("schedule %s not found", name)
+	}
+	e.state.Paused = paused
+	return sc.save()
+}
+
+// Load restores state of schedules saved by the last leader.
+func (sc *Scheduler) Load() error {
+	states, err := sc.load()
+	if err != nil {
+		return err
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for name, e := range sc.entries {
+		e.state = states[name]
+	}
+	return nil
+}
+
+func (sc *Scheduler) load() (map[string]scheduleState, error) {
+	states := map[string]scheduleState{}
+	if sc.state == nil {
+		return states, nil
+	}
+	buf, err := sc.state.Read(schedulesState)
+	if err != nil || buf == nil {
+		return states, err
+	}
+	if err := json.Unmarshal(buf, &states); err != nil {
+		return nil, fmt.Errorf("%s: %s", schedulesState, err)
+	}
+	return states, nil
+}
+
+// save writes state of schedules. sc.mu must be held.
+func (sc *Scheduler) save() error {
+	if sc.state == nil {
+		return nil
+	}
+	states := map[string]scheduleState{}
+	for name, e := range sc.entries {
+		states[name] = e.state
+	}
+	buf, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	return sc.state.Write(schedulesState, buf)
+}
+
+// scheduleLocation returns the time zone the schedule runs in.
+func scheduleLocation(s config.Schedule, conf *config.Config) (*time.Location, error) {
+	name := s.Timezone
+	if name == "" {
+		name = conf.Timezone
+	}
+	if name == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid timezone %s: %s", s.Name, name, err)
+	}
+	return loc, nil
+}
+
+// zonedSchedule evaluates a cron schedule in the time zone.
+type zonedSchedule struct {
+	spec     cron.Schedule
+	location *time.Location
+}
+
+func (z zonedSchedule) Next(t time.Time) time.Time {
+	t = t.In(z.location)
+	// Evaluate the schedule on the wall clock so that DST transitions neither repeat nor skip runs.
+	// When the clock goes back, the same wall clock time comes twice and runs only the first time.
+	wall := wallClock(t)
+	for {
+		wall = z.spec.Next(wall)
+		if wall.IsZero() {
+			return wall
+		}
+		if next := fromWallClock(wall, z.location); next.After(t) {
+			return next
+		}
+	}
+}
+
+// wallClock returns the time as if it were in UTC ignoring the offset.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
+
+// fromWallClock returns the time of the wall clock in loc.
+// A wall clock time skipped when the clock goes forward becomes the first instant after the gap.
+func fromWallClock(wall time.Time, loc *time.Location) time.Time {
+	t := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), 0, loc)
+	if wallClock(t).Equal(wall) {
+		return t
+	}
+	// Search the first second whose wall clock is after the skipped one.
+	lo, hi := t.Unix()-24*60*60, t.Unix()+24*60*60
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		if wallClock(time.Unix(mid, 0).In(loc)).After(wall) {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return time.Unix(hi, 0).In(loc)
+}
+
+// scheduledJob runs a schedule and returns the started build.
+type scheduledJob func() (*drone.Build, error)
+
+func newScheduledJob(s config.Schedule, servers *drone.Servers, client slackClient, deploy deployFunc, conf *config.Config) (scheduledJob, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+
+	switch s.Type {
+	case config.ScheduleRestartLatestOnBranch:
+		return func() (*drone.Build, error) {
+			d := servers.ForRepo(s.Repo)
+			build, err := d.GetLatestBuild(s.Repo, s.Branch, s.Status, nil)
+			if err != nil {
+				return nil, err
+			}
+			return d.StartBuild(s.Repo, build.Number)
+		}, nil
+	case config.ScheduleDeployBuildToEnv:
+		// Deployed through the queue so that it doesn't run with another deploy of the env.
+		return func() (*drone.Build, error) {
+			build, err := servers.ForRepo(s.Repo).GetLatestBuild(s.Repo, s.Branch, s.Status, nil)
+			if err != nil {
+				return nil, err
+			}
+			return deploy(s, build.Number)
+		}, nil
+	case config.ScheduleTriggerBranchBuild:
+		return func() (*drone.Build, error) {
+			return servers.ForRepo(s.Repo).CreateBuild(s.Repo, s.Branch, nil)
+		}, nil
+	case config.SchedulePostStatusReport:
+		st := Status{slack: client, drone: servers, config: conf}
+		return func() (*drone.Build, error) {
+			st.summary(s.Channel, s.Repos)
+			return nil, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("%s: unknown schedule type %s", s.Name, s.Type)
+}
+
+// runSchedule runs the job and posts the result to the report channel.
+func runSchedule(s config.Schedule, job scheduledJob, client slackClient, conf *config.Config) (*drone.Build, error) {
+	build, err := job()
+	if err != nil {
+		logger.Error("Failed to run schedule", zap.String("name", s.Name), zap.String("detail", err.Error()))
+	} else {
+		logger.Info("Run schedule", zap.String("name", s.Name))
+	}
+
+	channel := s.ReportChannel
+	if channel == "" {
+		channel = conf.ScheduleChannel
+	}
+	if channel == "" || (build == nil && err == nil) {
+		return build, err
+	}
+
+	params := slack.PostMessageParameters{
+		Attachments: ScheduleResultAttachments(s, build, err, conf),
+	}
+	if _, _, err := client.PostMessage(channel, "", params); err != nil {
+		logger.Error("Failed to post message", zap.String("detail", err.Error()))
+	}
+	return build, err
+}
+
+func ScheduleResultAttachments(s config.Schedule, build *drone.Build, err error, conf *config.Config) []slack.Attachment {
+	if err != nil {
+		return []slack.Attachment{
+			slack.Attachment{
+				Text:  fmt.Sprintf("スケジュール「%s」の実行に失敗したよ...\n%s", s.Name, err),
+				Color: "danger",
+			},
+		}
+	}
+	return []slack.Attachment{
+		slack.Attachment{
+			Text: fmt.Sprintf("スケジュール「%s」を実行したよ！", s.Name),
+			Fields: []slack.AttachmentField{
+				slack.AttachmentField{
+					Title: "リポジトリ",
+					Value: s.Repo,
+					Short: true,
+				},
+				slack.AttachmentField{
+					Title: "ビルド",
+					Value: fmt.Sprintf("<%s|#%d>", conf.BuildLink(s.Repo, build.Number), build.Number),
+					Short: true,
+				},
+			},
+			Color: "good",
+		},
+	}
+}
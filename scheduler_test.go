@@ -0,0 +1,155 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/robfig/cron"
+	"github.com/vivitInc/maguro/config"
+)
+
+// fires returns times the schedule runs in [from, to) by moving a fake clock of the scheduler to each next run.
+func fires(t *testing.T, timezone, spec string, from, to time.Time) []time.Time {
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		t.Fatalf("LoadLocation: %s", err)
+	}
+	s, err := cron.Parse(spec)
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	clock := from
+	sc := &Scheduler{
+		now:   func() time.Time { return clock },
+		names: []string{"test"},
+		entries: map[string]*scheduleEntry{
+			"test": {
+				schedule: config.Schedule{Name: "test", Cron: spec},
+				location: loc,
+				spec:     zonedSchedule{s, loc},
+			},
+		},
+	}
+
+	list := []time.Time{}
+	for i := 0; i < 1000; i++ {
+		next := sc.List()[0].Next
+		if !next.After(clock) {
+			t.Fatalf("next run %s is not after %s", next, clock)
+		}
+		if !next.Before(to) {
+			return list
+		}
+		list = append(list, next.In(loc))
+		clock = next
+	}
+	t.Fatalf("too many runs from %s", from)
+	return nil
+}
+
+func formatTimes(list []time.Time) []string {
+	strs := []string{}
+	for _, t := range list {
+		strs = append(strs, t.Format("2006-01-02 15:04 MST"))
+	}
+	return strs
+}
+
+func TestZonedScheduleNext(t *testing.T) {
+	tests := []struct {
+		name     string
+		timezone string
+		cron     string
+		// from and to are in UTC.
+		from, to string
+		want     []string
+	}{
+		{
+			name:     "no DST",
+			timezone: "Asia/Tokyo",
+			cron:     "0 30 1 * * *",
+			from:     "2026-10-31T00:00:00Z",
+			to:       "2026-11-02T00:00:00Z",
+			want:     []string{"2026-11-01 01:30 JST", "2026-11-02 01:30 JST"},
+		},
+		{
+			name:     "no DST hourly",
+			timezone: "Asia/Tokyo",
+			cron:     "0 0 * * * *",
+			from:     "2026-10-31T23:30:00Z",
+			to:       "2026-11-01T02:30:00Z",
+			want:     []string{"2026-11-01 09:00 JST", "2026-11-01 10:00 JST", "2026-11-01 11:00 JST"},
+		},
+		{
+			name:     "repeated hour runs once",
+			timezone: "America/New_York",
+			cron:     "0 30 1 * * *",
+			from:     "2026-10-31T12:00:00Z",
+			to:       "2026-11-02T12:00:00Z",
+			want:     []string{"2026-11-01 01:30 EDT", "2026-11-02 01:30 EST"},
+		},
+		{
+			name:     "repeated hour runs once hourly",
+			timezone: "America/New_York",
+			cron:     "0 0 * * * *",
+			from:     "2026-11-01T03:30:00Z",
+			to:       "2026-11-01T08:30:00Z",
+			want:     []string{"2026-11-01 00:00 EDT", "2026-11-01 01:00 EDT", "2026-11-01 02:00 EST", "2026-11-01 03:00 EST"},
+		},
+		{
+			name:     "skipped time runs once after the gap",
+			timezone: "America/New_York",
+			cron:     "0 30 2 * * *",
+			from:     "2026-03-07T12:00:00Z",
+			to:       "2026-03-10T12:00:00Z",
+			// 02:30 doesn't exist on 2026-03-08.
+			want: []string{"2026-03-08 03:00 EDT", "2026-03-09 02:30 EDT", "2026-03-10 02:30 EDT"},
+		},
+		{
+			name:     "skipped hour runs once after the gap hourly",
+			timezone: "America/New_York",
+			cron:     "0 0 * * * *",
+			from:     "2026-03-08T04:30:00Z",
+			to:       "2026-03-08T08:30:00Z",
+			want:     []string{"2026-03-08 00:00 EST", "2026-03-08 01:00 EST", "2026-03-08 03:00 EDT", "2026-03-08 04:00 EDT"},
+		},
+	}
+	for _, tt := range tests {
+		from, _ := time.Parse(time.RFC3339, tt.from)
+		to, _ := time.Parse(time.RFC3339, tt.to)
+		got := formatTimes(fires(t, tt.timezone, tt.cron, from, to))
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: runs = %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: runs = %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestZonedScheduleRunsOnceADay(t *testing.T) {
+	from, _ := time.Parse(time.RFC3339, "2026-01-01T00:00:00Z")
+	to, _ := time.Parse(time.RFC3339, "2027-01-01T00:00:00Z")
+	for _, timezone := range []string{"Asia/Tokyo", "America/New_York"} {
+		// 01:30 comes twice in New York on 2026-11-01 and 02:30 doesn't come on 2026-03-08.
+		for _, spec := range []string{"0 30 1 * * *", "0 30 2 * * *"} {
+			days := map[string]int{}
+			for _, run := range fires(t, timezone, spec, from, to) {
+				days[run.Format("2006-01-02")]++
+			}
+			for day, n := range days {
+				if n != 1 {
+					t.Errorf("%s %s: %d runs on %s", timezone, spec, n, day)
+				}
+			}
+			// The year in UTC misses a local day at either end.
+			if len(days) < 364 {
+				t.Errorf("%s %s: runs on %d days", timezone, spec, len(days))
+			}
+		}
+	}
+}
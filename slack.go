@@ -10,25 +10,59 @@ import (
 	"go.uber.org/zap"
 )
 
+// slackClient is the set of Slack API maguro uses.
+// *slack.Client implements it.
+type slackClient interface {
+	PostMessage(channel, text string, params slack.PostMessageParameters) (string, string, error)
+}
+
+var _ slackClient = (*slack.Client)(nil)
+
 type SlackListener struct {
+	// client is used for RTM and api for the other API calls.
 	client    *slack.Client
+	api       slackClient
 	botID     string
 	channelID string
-	drone     *drone.Drone
-	config    *config.Config
+	drone     *drone.Servers
+	config    *config.Store
+	scheduler *Scheduler
+	deploys   *DeployScheduler
+	watcher   *DeployWatcher
+	queue     *DeployQueue
+	events    *BuildEvents
+	users     *UserDirectory
+	health    *Health
 }
 
-func (s *SlackListener) ListenAndResponse() {
+// ListenAndResponse handles slack events until stop is closed.
+func (s *SlackListener) ListenAndResponse(stop <-chan struct{}) {
 	rtm := s.client.NewRTM()
 
 	// Start listening slack events
 	go rtm.ManageConnection()
 
 	// Handle slack events
-	for msg := range rtm.IncomingEvents {
-		switch ev := msg.Data.(type) {
-		case *slack.MessageEvent:
-			s.handleMessageEvent(ev)
+	for {
+		select {
+		case msg := <-rtm.IncomingEvents:
+			switch ev := msg.Data.(type) {
+			case *slack.MessageEvent:
+				s.handleMessageEvent(ev)
+			case *slack.ConnectedEvent:
+				logger.Info("Connected to slack", zap.Int("count", ev.ConnectionCount))
+				s.health.SlackConnected(true, "")
+			case *slack.DisconnectedEvent:
+				s.health.SlackConnected(false, "disconnected")
+			case *slack.InvalidAuthEvent:
+				logger.Error("Invalid slack token")
+				s.health.SlackConnected(false, "invalid auth")
+			}
+		case <-stop:
+			if err := rtm.Disconnect(); err != nil {
+				logger.Error("Failed to disconnect", zap.String("detail", err.Error()))
+			}
+			return
 		}
 	}
 }
@@ -39,8 +73,9 @@ func (s *SlackListener) handleMessageEvent(ev *slack.MessageEvent) {
 		return
 	}
 
+	conf := s.config.Get()
 	var allowed = false
-	for _, c := range s.config.Channels {
+	for _, c := range conf.Channels {
 		if c == ev.Channel {
 			allowed = true
 			break
@@ -64,15 +99,28 @@ func (s *SlackListener) handleMessageEvent(ev *slack.MessageEvent) {
 
 	switch m[0] {
 	case "build":
-		b := Build{slack: s.client, drone: s.drone}
+		commandsTotal.Inc("build")
+		b := Build{slack: s.api, drone: s.drone, config: conf}
 		b.SelectRepo(ev)
 		return
 	case "tomoka", "ともか":
-		Tomoka(s.client, ev)
+		commandsTotal.Inc("tomoka")
+		Tomoka(s.api, conf, ev)
 		return
 	case "deploy":
-		d := Deploy{slack: s.client, drone: s.drone, config: s.config}
-		d.SelectRepo(ev)
+		commandsTotal.Inc("deploy")
+		d := Deploy{slack: s.api, drone: s.drone, config: s.config, deploys: s.deploys, watcher: s.watcher, events: s.events, users: s.users, queue: s.queue}
+		d.Handle(ev, m[1:])
+		return
+	case "schedule":
+		commandsTotal.Inc("schedule")
+		sc := Schedule{slack: s.api, scheduler: s.scheduler}
+		sc.Handle(ev, m[1:])
+		return
+	case "status":
+		commandsTotal.Inc("status")
+		st := Status{slack: s.api, drone: s.drone, config: conf}
+		st.Show(ev, m[1:])
 		return
 	}
 }
@@ -0,0 +1,113 @@
+package slacktest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	"github.com/nlopes/slack"
+)
+
+// Harness replays interactive message callbacks against an interaction handler.
+//
+//	h := slacktest.Harness{Handler: handler, Token: "token", Channel: "C0001", ResponseURL: srv.ResponseURL()}
+//	msg := h.Start(posted)
+//	msg, _ = h.Select(msg, "deploy_action_select_repo", "owner/repo")
+//	msg, _ = h.Click(msg, "deploy_action_confirm")
+type Harness struct {
+	Handler     http.Handler
+	Token       string
+	Channel     string
+	User        string
+	ResponseURL string
+}
+
+// Start converts a message captured by Server into the original message of callbacks.
+func (h *Harness) Start(m Message) *slack.Message {
+	msg := &slack.Message{}
+	msg.Channel = m.Channel
+	msg.Text = m.Text
+	msg.Timestamp = m.Timestamp
+	msg.Attachments = m.Attachments
+	return msg
+}
+
+// Select chooses the option of the select menu named name.
+func (h *Harness) Select(original *slack.Message, name, value string) (*slack.Message, error) {
+	action, err := FindAction(original, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range action.Options {
+		if o.Value == value {
+			action.SelectedOptions = []slack.AttachmentActionOption{o}
+			return h.send(original, action)
+		}
+	}
+	return nil, fmt.Errorf("slacktest: option %s not found in %s", value, name)
+}
+
+// Click presses the button named name.
+func (h *Harness) Click(original *slack.Message, name string) (*slack.Message, error) {
+	action, err := FindAction(original, name)
+	if err != nil {
+		return nil, err
+	}
+	return h.send(original, action)
+}
+
+func (h *Harness) send(original *slack.Message, action slack.AttachmentAction) (*slack.Message, error) {
+	callback := slack.AttachmentActionCallback{
+		Actions:         []slack.AttachmentAction{action},
+		CallbackID:      callbackID(original),
+		OriginalMessage: *original,
+		Token:           h.Token,
+		ResponseURL:     h.ResponseURL + h.Channel,
+		MessageTs:       original.Timestamp,
+	}
+	callback.Channel.ID = h.Channel
+	callback.User.ID = h.User
+
+	payload, err := json.Marshal(callback)
+	if err != nil {
+		return nil, err
+	}
+	body := "payload=" + url.QueryEscape(string(payload))
+	req := httptest.NewRequest(http.MethodPost, "/maguro/interaction", strings.NewReader(body))
+	req.Header.Set("Content-type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.Handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		return nil, fmt.Errorf("slacktest: %s returned %d", action.Name, rec.Code)
+	}
+	var msg slack.Message
+	if err := json.NewDecoder(rec.Body).Decode(&msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// FindAction returns the action named name in the message.
+func FindAction(msg *slack.Message, name string) (slack.AttachmentAction, error) {
+	for _, a := range msg.Attachments {
+		for _, action := range a.Actions {
+			if action.Name == name {
+				return action, nil
+			}
+		}
+	}
+	return slack.AttachmentAction{}, fmt.Errorf("slacktest: action %s not found", name)
+}
+
+func callbackID(msg *slack.Message) string {
+	for _, a := range msg.Attachments {
+		if a.CallbackID != "" {
+			return a.CallbackID
+		}
+	}
+	return ""
+}
@@ -0,0 +1,189 @@
+// Package slacktest provides a fake Slack API server and a harness replaying
+// interactive message callbacks.
+//
+//	srv := slacktest.NewServer()
+//	defer srv.Close()
+//	slack.SLACK_API = srv.APIURL()
+package slacktest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// Message is a message captured by the server.
+type Message struct {
+	// Method is chat.postMessage, chat.update or response_url.
+	Method          string
+	Channel         string
+	Text            string
+	Timestamp       string
+	ThreadTimestamp string
+	Attachments     []slack.Attachment
+}
+
+// Server is a fake Slack API server.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	messages []Message
+	seq      int
+	notify   chan struct{}
+	users    []slack.User
+	// user ID -> custom profile field ID -> value
+	fields map[string]map[string]string
+}
+
+func NewServer() *Server {
+	s := &Server{notify: make(chan struct{}, 1), fields: map[string]map[string]string{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/chat.postMessage", s.handleChat("chat.postMessage"))
+	mux.HandleFunc("/api/chat.update", s.handleChat("chat.update"))
+	mux.HandleFunc("/api/auth.test", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"ok": true, "user_id": "UMAGURO", "team_id": "TMAGURO"})
+	})
+	mux.HandleFunc("/api/users.list", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		writeJSON(w, map[string]interface{}{"ok": true, "members": s.users})
+	})
+	mux.HandleFunc("/api/users.profile.get", s.handleProfile)
+	mux.HandleFunc("/response/", s.handleResponse)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// APIURL returns the base URL of Slack API.
+func (s *Server) APIURL() string {
+	return s.URL + "/api/"
+}
+
+// ResponseURL returns a response_url of interactive messages.
+func (s *Server) ResponseURL() string {
+	return s.URL + "/response/"
+}
+
+// AddUser adds a user returned by users.list.
+// fields are custom profile fields returned by users.profile.get.
+func (s *Server) AddUser(u slack.User, fields map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = append(s.users, u)
+	s.fields[u.ID] = fields
+}
+
+// Messages returns captured messages in order.
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message{}, s.messages...)
+}
+
+// WaitMessages waits until n messages are captured.
+func (s *Server) WaitMessages(n int, timeout time.Duration) ([]Message, error) {
+	deadline := time.After(timeout)
+	for {
+		if messages := s.Messages(); len(messages) >= n {
+			return messages, nil
+		}
+		select {
+		case <-s.notify:
+		case <-deadline:
+			return s.Messages(), fmt.Errorf("slacktest: %d messages received, want %d", len(s.Messages()), n)
+		}
+	}
+}
+
+func (s *Server) capture(m Message) Message {
+	s.mu.Lock()
+	s.seq++
+	if m.Timestamp == "" {
+		m.Timestamp = fmt.Sprintf("%d.%06d", time.Now().Unix(), s.seq)
+	}
+	s.messages = append(s.messages, m)
+	s.mu.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return m
+}
+
+func (s *Server) handleChat(method string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			writeJSON(w, map[string]interface{}{"ok": false, "error": err.Error()})
+			return
+		}
+		m := Message{
+			Method:          method,
+			Channel:         r.FormValue("channel"),
+			Text:            r.FormValue("text"),
+			Timestamp:       r.FormValue("ts"),
+			ThreadTimestamp: r.FormValue("thread_ts"),
+		}
+		if a := r.FormValue("attachments"); a != "" {
+			if err := json.Unmarshal([]byte(a), &m.Attachments); err != nil {
+				writeJSON(w, map[string]interface{}{"ok": false, "error": err.Error()})
+				return
+			}
+		}
+		m = s.capture(m)
+		writeJSON(w, map[string]interface{}{"ok": true, "channel": m.Channel, "ts": m.Timestamp, "text": m.Text})
+	}
+}
+
+func (s *Server) handleProfile(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fields, ok := s.fields[r.FormValue("user")]
+	if !ok {
+		writeJSON(w, map[string]interface{}{"ok": false, "error": "user_not_found"})
+		return
+	}
+	profile := map[string]interface{}{}
+	for id, v := range fields {
+		profile[id] = map[string]string{"value": v, "alt": ""}
+	}
+	writeJSON(w, map[string]interface{}{"ok": true, "profile": map[string]interface{}{"fields": profile}})
+}
+
+func (s *Server) handleResponse(w http.ResponseWriter, r *http.Request) {
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var params slack.PostMessageParameters
+	if err := json.Unmarshal(buf, &params); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var text struct {
+		Text string `json:"text"`
+	}
+	json.Unmarshal(buf, &text)
+	s.capture(Message{
+		Method:      "response_url",
+		Channel:     strings.TrimPrefix(r.URL.Path, "/response/"),
+		Text:        text.Text,
+		Attachments: params.Attachments,
+	})
+	w.WriteHeader(http.StatusOK)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(v)
+}
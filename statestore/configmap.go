@@ -0,0 +1,140 @@
+package statestore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/vivitInc/maguro/kube"
+)
+
+// configMapRetry is how many times Write retries when another replica updated the ConfigMap first.
+const configMapRetry = 3
+
+// ConfigMap is a Store saving documents as keys of a Kubernetes ConfigMap,
+// which every replica reads. A ConfigMap holds up to 1MiB.
+// The service account needs get, create and update on configmaps.
+type ConfigMap struct {
+	Namespace string
+	Name      string
+
+	kube *kube.Client
+}
+
+type configMap struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   configMapMetadata `json:"metadata"`
+	Data       map[string]string `json:"data"`
+}
+
+type configMapMetadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+// NewInClusterConfigMap returns ConfigMap using the service account of the pod.
+// The namespace of the pod is used if namespace is empty.
+func NewInClusterConfigMap(namespace, name string) (*ConfigMap, error) {
+	client, err := kube.NewInClusterClient(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return NewConfigMap(client, name), nil
+}
+
+// NewConfigMap returns ConfigMap of name in the namespace of client.
+func NewConfigMap(client *kube.Client, name string) *ConfigMap {
+	return &ConfigMap{Namespace: client.Namespace, Name: name, kube: client}
+}
+
+func (c *ConfigMap) Read(name string) ([]byte, error) {
+	current, err := c.get()
+	if err != nil || current == nil {
+		return nil, err
+	}
+	data, ok := current.Data[name]
+	if !ok {
+		return nil, nil
+	}
+	return []byte(data), nil
+}
+
+func (c *ConfigMap) Write(name string, data []byte) error {
+	for i := 0; i < configMapRetry; i++ {
+		current, err := c.get()
+		if err != nil {
+			return err
+		}
+		method, path := http.MethodPut, c.path(c.Name)
+		if current == nil {
+			method, path = http.MethodPost, c.path("")
+			current = &configMap{
+				APIVersion: "v1",
+				Kind:       "ConfigMap",
+				Metadata:   configMapMetadata{Name: c.Name, Namespace: c.Namespace},
+			}
+		}
+		if current.Data == nil {
+			current.Data = map[string]string{}
+		}
+		current.Data[name] = string(data)
+
+		// The resource version makes the update fail if another replica updated it first.
+		ok, err := c.write(method, path, current)
+		if err != nil || ok {
+			return err
+		}
+	}
+	return fmt.Errorf("configmap: %s: %s was updated concurrently", c.Name, name)
+}
+
+func (c *ConfigMap) path(name string) string {
+	path := fmt.Sprintf("/api/v1/namespaces/%s/configmaps", c.Namespace)
+	if name != "" {
+		path += "/" + name
+	}
+	return path
+}
+
+// get returns nil if the ConfigMap doesn't exist.
+func (c *ConfigMap) get() (*configMap, error) {
+	res, err := c.kube.Do(http.MethodGet, c.path(c.Name), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		var current configMap
+		if err := json.NewDecoder(res.Body).Decode(&current); err != nil {
+			return nil, err
+		}
+		return &current, nil
+	case http.StatusNotFound:
+		return nil, nil
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	return nil, fmt.Errorf("configmap: GET %s: %d %s", c.Name, res.StatusCode, body)
+}
+
+// write returns false if another replica created or updated the ConfigMap first.
+func (c *ConfigMap) write(method, path string, body *configMap) (bool, error) {
+	res, err := c.kube.Do(method, path, body)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	}
+	buf, _ := ioutil.ReadAll(res.Body)
+	return false, fmt.Errorf("configmap: %s %s: %d %s", method, c.Name, res.StatusCode, buf)
+}
@@ -0,0 +1,50 @@
+// Package statestore saves state which survives restarts and leader changes.
+package statestore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Store keeps named documents such as queue.json.
+type Store interface {
+	// Read returns nil if the document doesn't exist.
+	Read(name string) ([]byte, error)
+	Write(name string, data []byte) error
+}
+
+// Dir is a Store saving documents as files in the directory.
+// It is shared between replicas only if the directory is on a shared volume.
+type Dir string
+
+func (d Dir) Read(name string) ([]byte, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(string(d), name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return buf, err
+}
+
+// Write writes data to a temporary file and renames it
+// so that readers never see a partially written file.
+func (d Dir) Write(name string, data []byte) error {
+	path := filepath.Join(string(d), name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
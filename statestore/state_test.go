@@ -0,0 +1,152 @@
+package statestore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/vivitInc/maguro/kube"
+)
+
+func testStore(t *testing.T, s Store) {
+	if buf, err := s.Read("queue.json"); err != nil || buf != nil {
+		t.Fatalf("Read before Write = %q, %v", buf, err)
+	}
+	if err := s.Write("queue.json", []byte("[1]")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write("watches.json", []byte("[2]")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write("queue.json", []byte("[3]")); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"queue.json": "[3]", "watches.json": "[2]"} {
+		if buf, err := s.Read(name); err != nil || string(buf) != want {
+			t.Errorf("Read(%s) = %q, %v", name, buf, err)
+		}
+	}
+}
+
+func TestDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maguro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testStore(t, Dir(filepath.Join(dir, "state")))
+}
+
+// fakeConfigMaps is the API server keeping one ConfigMap.
+type fakeConfigMaps struct {
+	mu      sync.Mutex
+	current *configMap
+	version int
+	// beforePut is called once on the next PUT, e.g. to update the ConfigMap by another replica.
+	beforePut func(*configMap)
+}
+
+func (f *fakeConfigMaps) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var body configMap
+	if r.Method != http.MethodGet {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v1/namespaces/bot/configmaps/maguro-state":
+		if f.current == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(f.current)
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v1/namespaces/bot/configmaps":
+		if f.current != nil {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.store(&body)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && r.URL.Path == "/api/v1/namespaces/bot/configmaps/maguro-state":
+		if f.beforePut != nil {
+			f.beforePut(f.current)
+			f.store(f.current)
+			f.beforePut = nil
+		}
+		if f.current == nil || body.Metadata.ResourceVersion != f.current.Metadata.ResourceVersion {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.store(&body)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// store saves the ConfigMap as a new version. f.mu must be held.
+func (f *fakeConfigMaps) store(c *configMap) {
+	f.version++
+	saved := *c
+	saved.Data = map[string]string{}
+	for k, v := range c.Data {
+		saved.Data[k] = v
+	}
+	saved.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	f.current = &saved
+}
+
+func newTestConfigMap(t *testing.T, f *fakeConfigMaps) (*ConfigMap, func()) {
+	srv := httptest.NewServer(f)
+	token, err := ioutil.TempFile("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token.WriteString("token\n")
+	token.Close()
+	c := NewConfigMap(kube.NewClient(srv.URL, "bot", token.Name(), srv.Client()), "maguro-state")
+	return c, func() {
+		srv.Close()
+		os.Remove(token.Name())
+	}
+}
+
+func TestConfigMap(t *testing.T) {
+	c, closeServer := newTestConfigMap(t, &fakeConfigMaps{})
+	defer closeServer()
+	testStore(t, c)
+}
+
+func TestConfigMapConflict(t *testing.T) {
+	f := &fakeConfigMaps{}
+	c, closeServer := newTestConfigMap(t, f)
+	defer closeServer()
+	if err := c.Write("queue.json", []byte("[1]")); err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	f.beforePut = func(current *configMap) { current.Data["builds.json"] = "{}" }
+	f.mu.Unlock()
+	if err := c.Write("queue.json", []byte("[2]")); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"queue.json": "[2]", "builds.json": "{}"} {
+		if buf, err := c.Read(name); err != nil || string(buf) != want {
+			t.Errorf("Read(%s) = %q, %v", name, buf, err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nlopes/slack"
+	"github.com/vivitInc/maguro/config"
+	"github.com/vivitInc/maguro/drone"
+	"go.uber.org/zap"
+)
+
+const defaultStatusBranch = "master"
+
+type Status struct {
+	slack  slackClient
+	drone  *drone.Servers
+	config *config.Config
+}
+
+func StatusColor(status string) string {
+	switch status {
+	case "success":
+		return "good"
+	case "failure", "error", "killed":
+		return "danger"
+	}
+	return "warning"
+}
+
+func StatusAttachmentFields(build *drone.Build) []slack.AttachmentField {
+	return []slack.AttachmentField{
+		slack.AttachmentField{
+			Title: "ステータス",
+			Value: build.Status,
+			Short: true,
+		},
+		slack.AttachmentField{
+			Title: "コミット",
+			Value: build.Commit,
+			Short: true,
+		},
+		slack.AttachmentField{
+			Title: "作者",
+			Value: build.Author,
+			Short: true,
+		},
+		slack.AttachmentField{
+			Title: "所要時間",
+			Value: build.Duration().String(),
+			Short: true,
+		},
+	}
+}
+
+// Show posts latest builds.
+// Format: status [{owner}/{repo} [{branch}]]
+func (s *Status) Show(event *slack.MessageEvent, args []string) {
+	if len(args) == 0 {
+		s.summary(event.Channel, nil)
+		return
+	}
+
+	branch := ""
+	if len(args) > 1 {
+		branch = args[1]
+	}
+	s.detail(event.Channel, args[0], branch)
+}
+
+func (s *Status) detail(channel, name, branch string) {
+	if !strings.Contains(name, "/") {
+		s.post(channel, Message(fmt.Sprintf("%sはowner/repoの形で指定してね！", name), "danger"))
+		return
+	}
+
+	builds, err := s.drone.ForRepo(name).GetLatestBuilds(name)
+	if err != nil {
+		logger.Error("Failed to get latest builds", zap.String("detail", err.Error()))
+		s.post(channel, Message(fmt.Sprintf("エラーが発生したよ！\n%s", err), "danger"))
+		return
+	}
+
+	attachments := []slack.Attachment{}
+	for _, b := range builds {
+		if branch != "" && b.Branch != branch {
+			continue
+		}
+		attachments = append(attachments, slack.Attachment{
+			Title:     fmt.Sprintf("#%d %s", b.Number, b.Branch),
+			TitleLink: s.config.BuildLink(name, b.Number),
+			Text:      b.Message,
+			Fields:    StatusAttachmentFields(b),
+			Color:     StatusColor(b.Status),
+		})
+	}
+	if len(attachments) == 0 {
+		s.post(channel, Message(fmt.Sprintf("%sのビルドが見つからなかったよ！", name), "warning"))
+		return
+	}
+	s.post(channel, attachments)
+}
+
+// summary posts the latest master build of repos.
+// Repositories in config are used if repos is empty.
+func (s *Status) summary(channel string, repos []string) {
+	if len(repos) == 0 {
+		for _, r := range s.config.Repositories {
+			repos = append(repos, r.Name)
+		}
+	}
+
+	attachments := []slack.Attachment{}
+	for _, name := range repos {
+		builds, err := s.drone.ForRepo(name).GetLatestBuilds(name)
+		if err != nil {
+			logger.Error("Failed to get latest builds", zap.String("repo", name), zap.String("detail", err.Error()))
+			attachments = append(attachments, slack.Attachment{
+				Text:  fmt.Sprintf("%s: エラーが発生したよ！", name),
+				Color: "danger",
+			})
+			continue
+		}
+
+		var latest *drone.Build
+		for _, b := range builds {
+			if b.Branch == defaultStatusBranch {
+				latest = b
+				break
+			}
+		}
+		if latest == nil {
+			attachments = append(attachments, slack.Attachment{
+				Text: fmt.Sprintf("%s: %sのビルドがないよ", name, defaultStatusBranch),
+			})
+			continue
+		}
+
+		attachments = append(attachments, slack.Attachment{
+			Text: fmt.Sprintf(
+				"<%s|%s #%d> %s %s %s (%s)",
+				s.config.BuildLink(name, latest.Number),
+				name,
+				latest.Number,
+				latest.Status,
+				latest.Commit,
+				latest.Author,
+				latest.Duration(),
+			),
+			Color: StatusColor(latest.Status),
+		})
+	}
+	s.post(channel, attachments)
+}
+
+func (s *Status) post(channel string, attachments []slack.Attachment) {
+	params := slack.PostMessageParameters{
+		Attachments: attachments,
+	}
+	if _, _, err := s.slack.PostMessage(channel, "", params); err != nil {
+		logger.Error("Failed to post message", zap.String("detail", err.Error()))
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/vivitInc/maguro/config"
+	"go.uber.org/zap"
+)
+
+const (
+	// userCacheTTL is how long Slack users are cached.
+	userCacheTTL = 1 * time.Hour
+	// userRetryInterval is the interval of retrying failed refresh.
+	userRetryInterval = 5 * time.Minute
+	// userProfileInterval throttles users.profile.get under the rate limit of Slack (Tier 4).
+	userProfileInterval = 700 * time.Millisecond
+	// userProfileTimeout bounds a users.profile.get request so that a slow one doesn't stall the refresh.
+	userProfileTimeout = 5 * time.Second
+)
+
+// userLister lists Slack users. *slack.Client implements it.
+type userLister interface {
+	GetUsers() ([]slack.User, error)
+}
+
+var _ userLister = (*slack.Client)(nil)
+
+// DirectoryUser is a Slack user and the account of VCS.
+type DirectoryUser struct {
+	Slack string
+	Name  string
+	Login string
+	Email string
+}
+
+// UserDirectory maps Slack users to VCS accounts.
+// Users in config come first, then Slack users matched by email
+// or the profile field of login (slack_login_field).
+type UserDirectory struct {
+	config *config.Store
+	users  userLister
+	token  string
+	http   *http.Client
+	now    func() time.Time
+
+	mu         sync.Mutex
+	expiresAt  time.Time
+	refreshing bool
+	cached     []DirectoryUser
+}
+
+func NewUserDirectory(store *config.Store, users userLister, token string) *UserDirectory {
+	return &UserDirectory{
+		config: store,
+		users:  users,
+		token:  token,
+		http:   &http.Client{Timeout: userProfileTimeout},
+		now:    time.Now,
+	}
+}
+
+// FindByVCS returns the user of the commit author.
+func (d *UserDirectory) FindByVCS(login, email string) (DirectoryUser, bool) {
+	for _, u := range d.list() {
+		if (login != "" && strings.EqualFold(u.Login, login)) || (email != "" && strings.EqualFold(u.Email, email)) {
+			return u, true
+		}
+	}
+	return DirectoryUser{}, false
+}
+
+// FindBySlack returns the user of the Slack user ID.
+func (d *UserDirectory) FindBySlack(id string) (DirectoryUser, bool) {
+	for _, u := range d.list() {
+		if u.Slack == id {
+			return u, true
+		}
+	}
+	return DirectoryUser{}, false
+}
+
+// Mention returns the mention of the commit author, or the login if unknown.
+func (d *UserDirectory) Mention(login, email string) string {
+	if u, ok := d.FindByVCS(login, email); ok && u.Slack != "" {
+		return fmt.Sprintf("<@%s>", u.Slack)
+	}
+	if login != "" {
+		return login
+	}
+	return email
+}
+
+// Describe returns the Slack user with the VCS login. e.g. <@U90LAKZM0> (octocat)
+func (d *UserDirectory) Describe(id string) string {
+	if id == "" {
+		return ""
+	}
+	if u, ok := d.FindBySlack(id); ok && u.Login != "" {
+		return fmt.Sprintf("<@%s> (%s)", id, u.Login)
+	}
+	return fmt.Sprintf("<@%s>", id)
+}
+
+// list returns users in config and cached Slack users.
+// The cache is refreshed in background when it expires, and the stale cache is returned meanwhile
+// because listing all members takes long.
+func (d *UserDirectory) list() []DirectoryUser {
+	conf := d.config.Get()
+	list := []DirectoryUser{}
+	for _, u := range conf.Users {
+		list = append(list, DirectoryUser{Slack: u.Slack, Login: u.Login, Email: u.Email})
+	}
+	if d.users == nil {
+		return list
+	}
+
+	d.Refresh()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append(list, d.cached...)
+}
+
+// Refresh starts refreshing Slack users in background if the cache has expired.
+func (d *UserDirectory) Refresh() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.users == nil || d.refreshing || d.now().Before(d.expiresAt) {
+		return
+	}
+	d.refreshing = true
+	go d.refresh(d.config.Get().SlackLoginField)
+}
+
+func (d *UserDirectory) refresh(loginField string) {
+	cached, err := d.fetch(loginField)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.refreshing = false
+	if err != nil {
+		// Keep the old cache and retry after a while.
+		logger.Error("Failed to get slack users", zap.String("detail", err.Error()))
+		d.expiresAt = d.now().Add(userRetryInterval)
+		return
+	}
+	d.cached = cached
+	d.expiresAt = d.now().Add(userCacheTTL)
+}
+
+// fetch lists Slack users.
+// Users whose profile can't be read are listed without the login.
+func (d *UserDirectory) fetch(loginField string) ([]DirectoryUser, error) {
+	users, err := d.users.GetUsers()
+	if err != nil {
+		return nil, err
+	}
+	list := []DirectoryUser{}
+	for _, u := range users {
+		if u.Deleted || u.IsBot {
+			continue
+		}
+		name := u.Profile.DisplayName
+		if name == "" {
+			name = u.RealName
+		}
+		du := DirectoryUser{Slack: u.ID, Name: name, Email: u.Profile.Email}
+		if loginField != "" {
+			time.Sleep(userProfileInterval)
+			fields, err := d.profileFields(u.ID)
+			if err != nil {
+				logger.Warn("Failed to get slack profile", zap.String("user", u.ID), zap.String("detail", err.Error()))
+			}
+			du.Login = fields[loginField]
+		}
+		list = append(list, du)
+	}
+	return list, nil
+}
+
+// profileFields returns custom profile fields of the user by users.profile.get.
+func (d *UserDirectory) profileFields(id string) (map[string]string, error) {
+	values := url.Values{"token": {d.token}, "user": {id}}
+	res, err := d.http.PostForm(slack.SLACK_API+"users.profile.get", values)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		OK      bool   `json:"ok"`
+		Error   string `json:"error"`
+		Profile struct {
+			Fields map[string]struct {
+				Value string `json:"value"`
+			} `json:"fields"`
+		} `json:"profile"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if !body.OK {
+		return nil, fmt.Errorf("users.profile.get: %s", body.Error)
+	}
+	fields := map[string]string{}
+	for id, f := range body.Profile.Fields {
+		fields[id] = f.Value
+	}
+	return fields, nil
+}
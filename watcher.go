@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/vivitInc/maguro/statestore"
+	"go.uber.org/zap"
+)
+
+// deployWatch is a deploy build being watched until it finishes.
+type deployWatch struct {
+	Repo string `json:"repo"`
+	Env  string `json:"env"`
+	// From is the build number deployed.
+	From string `json:"from"`
+	// Build is the number of the deploy build.
+	Build   string `json:"build"`
+	Channel string `json:"channel"`
+	// ResponseURL is the response URL of the interactive message. It expires in 30 minutes.
+	ResponseURL string `json:"response_url"`
+	// ThreadTs is the message the result is posted to as a thread
+	// when ResponseURL is not available.
+	ThreadTs string `json:"thread_ts"`
+	// User is the Slack user ID who requested the deploy.
+	User      string    `json:"user"`
+	StartedAt time.Time `json:"started_at"`
+	// Deployment is the ID of GitHub Deployment. 0 if not created.
+	Deployment int64 `json:"deployment,omitempty"`
+}
+
+func (w deployWatch) id() string {
+	return fmt.Sprintf("%s:%s:%s", w.Repo, w.Env, w.Build)
+}
+
+// DeployWatcher runs goroutines watching deploy builds until they finish.
+// Watches are saved to the state store so that they are resumed after restart or by the next leader.
+type DeployWatcher struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	state   statestore.Store
+	watches map[string]deployWatch
+	// stopping is set when shutdown begins. Finished watches must not start new deploys after it.
+	stopping bool
+}
+
+// NewDeployWatcher restores watches from st. They are run by Resume.
+// Watches are not saved if st is nil.
+func NewDeployWatcher(st statestore.Store) (*DeployWatcher, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &DeployWatcher{ctx: ctx, cancel: cancel, state: st, watches: map[string]deployWatch{}}
+	if err := w.Load(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Load restores watches saved by the last leader. Watches must not be running.
+func (w *DeployWatcher) Load() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.state == nil {
+		return nil
+	}
+	buf, err := w.state.Read(watchesState)
+	if err != nil || buf == nil {
+		return err
+	}
+	var list []deployWatch
+	if err := json.Unmarshal(buf, &list); err != nil {
+		return fmt.Errorf("%s: %s", watchesState, err)
+	}
+	w.watches = map[string]deployWatch{}
+	for _, dw := range list {
+		w.watches[dw.id()] = dw
+	}
+	return nil
+}
+
+// Watch saves the watch and runs watch in a goroutine.
+// ctx passed to watch is canceled by Stop or when shutdown times out.
+// The watch is kept in the state store if watch returns by the cancel.
+func (w *DeployWatcher) Watch(dw deployWatch, watch func(ctx context.Context, dw deployWatch)) {
+	w.mu.Lock()
+	w.watches[dw.id()] = dw
+	if err := w.save(); err != nil {
+		logger.Error("Failed to save deploy watches", zap.String("detail", err.Error()))
+	}
+	w.mu.Unlock()
+
+	w.run(dw, watch)
+}
+
+// Update saves the changed watch if it is still watched.
+func (w *DeployWatcher) Update(dw deployWatch) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.watches[dw.id()]; !ok {
+		return
+	}
+	w.watches[dw.id()] = dw
+	if err := w.save(); err != nil {
+		logger.Error("Failed to save deploy watches", zap.String("detail", err.Error()))
+	}
+}
+
+// List returns saved watches.
+func (w *DeployWatcher) List() []deployWatch {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	list := []deployWatch{}
+	for _, dw := range w.watches {
+		list = append(list, dw)
+	}
+	return list
+}
+
+// Resume runs watches restored from the state store.
+func (w *DeployWatcher) Resume(watch func(ctx context.Context, dw deployWatch)) {
+	w.mu.Lock()
+	list := []deployWatch{}
+	for _, dw := range w.watches {
+		list = append(list, dw)
+	}
+	w.mu.Unlock()
+
+	for _, dw := range list {
+		logger.Info("Resume watching deploy", zap.String("repo", dw.Repo), zap.String("env", dw.Env), zap.String("build", dw.Build))
+		w.run(dw, watch)
+	}
+}
+
+func (w *DeployWatcher) run(dw deployWatch, watch func(ctx context.Context, dw deployWatch)) {
+	w.mu.Lock()
+	ctx := w.ctx
+	w.wg.Add(1)
+	w.mu.Unlock()
+	go func() {
+		defer w.wg.Done()
+		watch(ctx, dw)
+		if ctx.Err() != nil {
+			return
+		}
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		delete(w.watches, dw.id())
+		if err := w.save(); err != nil {
+			logger.Error("Failed to save deploy watches", zap.String("detail", err.Error()))
+		}
+	}()
+}
+
+// Stop cancels running watches and waits for them, e.g. when the leadership is lost.
+// They are kept in the state store for the next leader and can be resumed again.
+func (w *DeployWatcher) Stop() {
+	w.mu.Lock()
+	cancel := w.cancel
+	w.mu.Unlock()
+	cancel()
+	w.wg.Wait()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+}
+
+// BeginShutdown tells watches that the process is shutting down.
+func (w *DeployWatcher) BeginShutdown() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopping = true
+}
+
+// Stopping reports whether shutdown has begun.
+func (w *DeployWatcher) Stopping() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stopping
+}
+
+// Shutdown waits running watches. They are canceled when ctx is done
+// and resumed after restart.
+func (w *DeployWatcher) Shutdown(ctx context.Context) error {
+	w.BeginShutdown()
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		w.mu.Lock()
+		cancel := w.cancel
+		w.mu.Unlock()
+		cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// save writes watches. w.mu must be held.
+func (w *DeployWatcher) save() error {
+	if w.state == nil {
+		return nil
+	}
+	list := []deployWatch{}
+	for _, dw := range w.watches {
+		list = append(list, dw)
+	}
+	buf, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return w.state.Write(watchesState, buf)
+}
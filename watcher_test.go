@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/vivitInc/maguro/statestore"
+	"go.uber.org/zap"
+)
+
+// TestDeployWatcherHandOver hands over a deploy and the queue behind it to the next leader.
+func TestDeployWatcherHandOver(t *testing.T) {
+	logger = zap.NewNop()
+	dir, err := ioutil.TempDir("", "maguro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	st := statestore.Dir(dir)
+
+	old, err := NewDeployWatcher(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldQueue, err := NewDeployQueue(st, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dw := deployWatch{Repo: "owner/repo", Env: "production", From: "1", Build: "2"}
+	if _, ok, err := oldQueue.Acquire(QueuedDeploy{Repo: "owner/repo", Env: "production", Number: 1}); !ok || err != nil {
+		t.Fatalf("Acquire = %v, %v", ok, err)
+	}
+	old.Watch(dw, func(ctx context.Context, dw deployWatch) { <-ctx.Done() })
+	if _, ok, err := oldQueue.Acquire(QueuedDeploy{Repo: "owner/repo", Env: "production", Number: 3}); ok || err != nil {
+		t.Fatalf("Acquire = %v, %v", ok, err)
+	}
+	// The leadership is lost.
+	old.Stop()
+
+	next, err := NewDeployWatcher(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := next.List(); len(list) != 1 || list[0] != dw {
+		t.Fatalf("watches taken over = %+v", list)
+	}
+	queue, err := NewDeployQueue(st, next.List())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ready, err := queue.Ready(); len(ready) != 0 || err != nil {
+		t.Fatalf("ready while the deploy is running = %+v, %v", ready, err)
+	}
+
+	done := make(chan struct{})
+	next.Resume(func(ctx context.Context, resumed deployWatch) {
+		if resumed != dw {
+			t.Errorf("resumed %+v", resumed)
+		}
+		close(done)
+	})
+	<-done
+	if err := next.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if list := next.List(); len(list) != 0 {
+		t.Errorf("watches after the deploy finished = %+v", list)
+	}
+	qd, ok, err := queue.Release("owner/repo", "production")
+	if !ok || err != nil || qd.Number != 3 {
+		t.Errorf("Release = %+v, %v, %v", qd, ok, err)
+	}
+
+	// The old leader is elected again and sees nothing to resume.
+	if err := old.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := oldQueue.Load(old.List()); err != nil {
+		t.Fatal(err)
+	}
+	if list := old.List(); len(list) != 0 {
+		t.Errorf("watches loaded again = %+v", list)
+	}
+	if _, queued := oldQueue.List(); len(queued) != 0 {
+		t.Errorf("queued deploys loaded again = %+v", queued)
+	}
+	resumed := make(chan struct{})
+	old.Watch(dw, func(ctx context.Context, dw deployWatch) {
+		if ctx.Err() != nil {
+			t.Errorf("watch after Stop is canceled")
+		}
+		close(resumed)
+	})
+	select {
+	case <-resumed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("watch didn't run")
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/vivitInc/maguro/drone"
+	"go.uber.org/zap"
+)
+
+// webhookHandler receives drone global webhook and publishes build events.
+type webhookHandler struct {
+	secret string
+	events *BuildEvents
+}
+
+func (h webhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, webhookMaxBytes)
+	ev, err := drone.ParseWebhook(r, h.secret)
+	if err == drone.ErrInvalidSignature {
+		logger.Warn("Invalid webhook signature", zap.String("remote", r.RemoteAddr))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to parse webhook", zap.String("detail", err.Error()))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	webhooksTotal.Inc(ev.Event, ev.Action)
+	if ev.Event == "build" && ev.Build != nil {
+		h.events.Publish(BuildEvent{Repo: ev.Repo, Build: ev.Build})
+	}
+	w.WriteHeader(http.StatusOK)
+}